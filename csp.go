@@ -2,11 +2,20 @@
 package cspbuilder
 
 import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
 )
 
@@ -44,8 +53,10 @@ const (
 	Prefetch               = "prefetch-src"
 	Manifest               = "manifest-src"
 	ReportTo               = "report-to"
+	FencedFrame            = "fenced-frame-src"
 
-	upgradeInsecureRequests = "upgrade-insecure-requests;"
+	upgradeInsecureRequests = "upgrade-insecure-requests"
+	blockAllMixedContent    = "block-all-mixed-content"
 	reportUri               = "report-uri "
 
 	SHA256 HashType = 256
@@ -62,18 +73,96 @@ const (
 	StrictDynamic = "'strict-dynamic'"
 
 	UnsafeEval           = "'unsafe-eval'"
+	WasmUnsafeEval       = "'wasm-unsafe-eval'"
 	UnsafeInline         = "'unsafe-inline'"
 	UnsafeHashes         = "'unsafe-hashes'"
 	UnsafeAllowRedirects = "'unsafe-allow-redirects'"
 	ReportSample         = "'report-sample'"
 	TrustedScript        = "'script'"
 
+	// InlineSpeculationRules allows inline <script type="speculationrules">. Experimental
+	InlineSpeculationRules = "'inline-speculation-rules'"
+
+	// trusted-types keywords. Policy names are added as bare sources and
+	// must match the tt-policy-name grammar: ALPHA / DIGIT / "-#=_/@.%"
+	TrustedTypesAllowDuplicates = "'allow-duplicates'"
+	TrustedTypesWildcard        = "*"
+
 	Blob        = "blob:"
 	Data        = "data:"
 	Mediastream = "mediastream:"
 	Filesystem  = "filesystem:"
+	HTTPS       = "https:"
+	HTTP        = "http:"
+	WSS         = "wss:"
+	WS          = "ws:"
 )
 
+// StrictDirectives makes Policy.New and Policy.With panic on directive names that are not known CSP directives,
+// and on report-uri, upgrade-insecure-requests and block-all-mixed-content, which are set with Policy fields
+var StrictDirectives bool
+
+// knownDirectives are the directive names stored as directives
+
+var knownDirectives = map[string]bool{
+	Default:                true,
+	Connect:                true,
+	Font:                   true,
+	Frame:                  true,
+	Img:                    true,
+	Media:                  true,
+	Object:                 true,
+	Sandbox:                true,
+	Script:                 true,
+	Style:                  true,
+	BaseURI:                true,
+	Child:                  true,
+	FrameAncestors:         true,
+	Plugin:                 true,
+	Form:                   true,
+	TrustedTypes:           true,
+	RequireTrustedTypesFor: true,
+	StyleAttr:              true,
+	StyleElem:              true,
+	ScriptAttr:             true,
+	ScriptElem:             true,
+	Worker:                 true,
+	NavigateTo:             true,
+	Prefetch:               true,
+	Manifest:               true,
+	ReportTo:               true,
+	FencedFrame:            true,
+}
+
+// fieldDirectives are the directive names stored as Policy fields,
+// ReportURI, UpgradeInsecureRequests and BlockAllMixedContent
+var fieldDirectives = map[string]bool{
+	upgradeInsecureRequests: true,
+	blockAllMixedContent:    true,
+	"report-uri":            true,
+}
+
+// checkName panics on unknown directive name if StrictDirectives is set
+func checkName(name string) {
+	if !StrictDirectives {
+		return
+	}
+
+	if fieldDirectives[name] {
+		panic("cspbuilder: " + name + " is set with a Policy field")
+	}
+
+	if !knownDirectives[name] {
+		panic("cspbuilder: unknown directive " + name)
+	}
+}
+
+// ErrInvalidHashType is returned for hash types other than SHA256, SHA384 and SHA512
+var ErrInvalidHashType = errors.New("cspbuilder: invalid hash type")
+
+// ErrImmutableDirective is returned when decoding into a shared global or locked directive
+var ErrImmutableDirective = errors.New("cspbuilder: immutable directive")
+
 var (
 	SelfDirective = &Directive{sources: []string{Self}}
 	NoneDirective = &Directive{sources: []string{None}}
@@ -88,20 +177,90 @@ type Policy struct {
 	// ReportURI appends "report-uri <string>"
 	ReportURI string
 
+	// ReportURIs appends additional space separated endpoints to report-uri
+	ReportURIs []string
+
+	// ReportEndpoints are emitted as Report-To and Reporting-Endpoints headers by middleware. Add with SetReportTo()
+	ReportEndpoints []ReportEndpoint
+
 	// Compiled policy after running Build()
 	Compiled string
 
 	// UpgradeInsecureRequests appends "'upgrade-insecure-requests'"
 	UpgradeInsecureRequests bool
 
+	// BlockAllMixedContent appends "block-all-mixed-content".
+	// Deprecated by browsers and redundant with UpgradeInsecureRequests
+	BlockAllMixedContent bool
+
+	// ReportOnly tells middleware to set Content-Security-Policy-Report-Only header
+	ReportOnly bool
+
+	// Pretty separates directives with "; " instead of ";"
+	Pretty bool
+
+	// StripReportSample omits 'report-sample' from the compiled policy when neither report-uri
+	// nor report-to is configured, since no report would carry the sample
+	StripReportSample bool
+
+	// Ordered writes directives in the order they were added instead of default-src first
+	Ordered bool
+
+	// TrailingSemicolon ends the compiled policy with ";" for parsers that require it
+	TrailingSemicolon bool
+
 	// RequireNonce is set if policy must run WithNonce()
 	RequireNonce bool
+
+	// RandReader is the entropy source for nonces, e.g. NoncePool. Defaults to crypto/rand.Reader when nil
+	RandReader io.Reader
+
+	// NonceEncoding encodes nonces generated by WithNonce. Defaults to base64.RawURLEncoding when nil.
+	// Use base64.StdEncoding for parsers that reject unpadded or URL-safe base64.
+	NonceEncoding *base64.Encoding
+
+	// order of directive names as added, see Ordered
+	order []string
+
+	// locked directive names, see LockDirective()
+	locked map[string]bool
+
+	// state is the *compiledState stored by Build(), read by WithNonce and SetHeader
+	// so requests sharing the policy never build it concurrently
+	state atomic.Value
+
+	// mu serializes Build()
+	mu sync.Mutex
+}
+
+// compiledState is a built policy. It is replaced, never modified, once stored.
+type compiledState struct {
+	compiled     string
+	requireNonce bool
+
+	// nonceAt is the offset of the single nonce placeholder in compiled, so WithNonce()
+	// can concatenate instead of replace. -1 if there are none or several.
+	nonceAt int
+
+	// reportTo and reportingEndpoints are the Report-To and Reporting-Endpoints header values
+	reportTo           string
+	reportingEndpoints string
+
+	// pol is a copy of the built policy, merged with request directives by SetMergedHeader
+	pol *Policy
 }
 
 type Directive struct {
 	sources []string
 	// SourceFlag sourceFlag
 	requireNonce bool
+
+	// locked directives panic on modification, see Policy.LockDirective()
+	locked bool
+
+	// Note is a human readable comment for auditing, e.g. why a host is allowed.
+	// It is serialized to JSON but never written to the policy.
+	Note string
 }
 
 // SetNoncePlaceholder changes the nonce placeholder value $NONCE to your csp middleware's.
@@ -113,20 +272,63 @@ func SetNoncePlaceholder(ph string) {
 }
 
 // Starter creates new policy with sensible defaults
-// default-src 'none'; script-src 'self'; connect-src 'self'; img-src 'self'; style-src 'self'; base-uri 'self';form-action 'self'
+// default-src 'none'; script-src 'self'; connect-src 'self'; img-src 'self'; style-src 'self'; base-uri 'self';form-action 'self';object-src 'none'
 // https://content-security-policy.com/
 func Starter() *Policy {
 	pol := &Policy{}
 	pol.dirs = make(map[string]*Directive)
 
-	pol.dirs[Default] = NoneDirective
-	pol.dirs[BaseURI] = SelfDirective
-	pol.dirs[Script] = SelfDirective
-	pol.dirs[Connect] = SelfDirective
-	pol.dirs[Img] = SelfDirective
-	pol.dirs[Style] = SelfDirective
-	pol.dirs[Form] = SelfDirective
+	pol.setDir(Default, &Directive{sources: []string{None}})
+	pol.setDir(BaseURI, &Directive{sources: []string{Self}})
+	pol.setDir(Script, &Directive{sources: []string{Self}})
+	pol.setDir(Connect, &Directive{sources: []string{Self}})
+	pol.setDir(Img, &Directive{sources: []string{Self}})
+	pol.setDir(Style, &Directive{sources: []string{Self}})
+	pol.setDir(Form, &Directive{sources: []string{Self}})
+	pol.setDir(Object, &Directive{sources: []string{None}})
+
+	return pol
+}
+
+// StarterOptions configures StarterWith
+type StarterOptions struct {
+	// ReportURI sets Policy.ReportURI
+	ReportURI string
+
+	// UpgradeInsecure sets Policy.UpgradeInsecureRequests
+	UpgradeInsecure bool
+
+	// ScriptNonce adds the nonce placeholder to script-src
+	ScriptNonce bool
+}
+
+// StarterWith creates Starter() policy configured by opts
+func StarterWith(opts StarterOptions) *Policy {
+	pol := Starter()
+	pol.ReportURI = opts.ReportURI
+	pol.UpgradeInsecureRequests = opts.UpgradeInsecure
+
+	if opts.ScriptNonce {
+		pol.dirs[Script].Add(Nonce)
+		pol.RequireNonce = true
+	}
+
+	return pol
+}
+
+// StrictCSP creates the nonce based strict policy recommended by Google, in this order:
+// script-src $NONCE 'strict-dynamic' https: 'unsafe-inline'; object-src 'none'; base-uri 'none'
+// https: and 'unsafe-inline' are fallbacks for browsers without 'strict-dynamic' or nonce support.
+// https://web.dev/articles/strict-csp
+func StrictCSP() *Policy {
+	pol := New()
+	pol.Ordered = true
 
+	pol.New(Script, Nonce, StrictDynamic, HTTPS, UnsafeInline)
+	pol.New(Object, None)
+	pol.New(BaseURI, None)
+
+	pol.RequireNonce = true
 	return pol
 }
 
@@ -138,240 +340,1384 @@ func New() *Policy {
 	return pol
 }
 
-// With adds directive to policy.
-// Existing directive is replaced.
-func (pp *Policy) With(name string, d *Directive) *Policy {
-	if pp.dirs == nil {
-		pp.dirs = make(map[string]*Directive)
+// FromMap builds a policy from directive names mapped to sources, the inverse of Map().
+// upgrade-insecure-requests and block-all-mixed-content keys set the matching flags,
+// report-uri sets ReportURI and ReportURIs. Sources may include the nonce placeholder.
+func FromMap(m map[string][]string) *Policy {
+	pol := New()
+
+	for name, sources := range m {
+		switch strings.ToLower(name) {
+		case upgradeInsecureRequests:
+			pol.UpgradeInsecureRequests = true
+		case blockAllMixedContent:
+			pol.BlockAllMixedContent = true
+		case "report-uri":
+			if len(sources) > 0 {
+				pol.ReportURI = sources[0]
+				pol.ReportURIs = append([]string(nil), sources[1:]...)
+			}
+		default:
+			pol.New(name, sources...)
+		}
 	}
 
-	pp.dirs[name] = d
+	return pol
+}
+
+// With adds directive to policy.
+// Existing directive is replaced. Directive names are case-insensitive.
+func (pp *Policy) With(name string, d *Directive) *Policy {
+	name = strings.ToLower(name)
+	checkName(name)
+	pp.setDir(name, d)
 	return pp
 }
 
 // New directive added to policy.
-// Existing directive is replaced.
+// Existing directive is replaced. Directive names are case-insensitive.
 func (pp *Policy) New(name string, sources ...string) *Directive {
-	if pp.dirs == nil {
-		pp.dirs = make(map[string]*Directive)
-	}
+	name = strings.ToLower(name)
+	checkName(name)
 
 	d := &Directive{}
-	pp.dirs[name] = d
+	pp.setDir(name, d)
 	if len(sources) > 0 {
 		d.Add(sources...)
 	}
 	return d
 }
 
-// Remove directive from policy
-func (pp *Policy) Remove(name string) {
-	delete(pp.dirs, name)
+// NewFromSlice is New with sources passed as a slice. sources is copied.
+func (pp *Policy) NewFromSlice(name string, sources []string) *Directive {
+	return pp.New(name, sources...)
 }
 
-// write directive.
-// Used by Policy.Build()
-func (d *Directive) write(sb *strings.Builder) {
-	n := 1
-	if sb == nil {
-		sb = &strings.Builder{}
+// HardenDefaults adds object-src 'none', base-uri 'self' and frame-ancestors 'none' if absent.
+// Existing directives are not modified.
+func (pp *Policy) HardenDefaults() *Policy {
+	if _, ok := pp.dirs[Object]; !ok {
+		pp.setDir(Object, &Directive{sources: []string{None}})
 	}
 
-	if len(d.sources) > 0 {
-		n = len(d.sources) - 1
-		for i := 0; i < len(d.sources); i++ {
-			n += len(d.sources[i])
+	if _, ok := pp.dirs[BaseURI]; !ok {
+		pp.setDir(BaseURI, &Directive{sources: []string{Self}})
+	}
+
+	if _, ok := pp.dirs[FrameAncestors]; !ok {
+		pp.setDir(FrameAncestors, &Directive{sources: []string{None}})
+	}
+
+	return pp
+}
+
+// ExpandChildSrc copies child-src sources into frame-src and worker-src if absent.
+// Browsers fall back to child-src for both; this makes the fallback explicit.
+func (pp *Policy) ExpandChildSrc() *Policy {
+	child, ok := pp.dirs[Child]
+	if !ok {
+		return pp
+	}
+
+	for _, name := range []string{Frame, Worker} {
+		if _, ok := pp.dirs[name]; !ok {
+			pp.setDir(name, child.clone())
 		}
+	}
 
-		sb.Grow(n + 1)
-		sb.WriteString(d.sources[0])
+	return pp
+}
 
-		for i := 1; i < len(d.sources); i++ {
-			sb.WriteByte(' ')
-			sb.WriteString(d.sources[i])
+// Append adds sources to an existing directive, or creates it.
+// Unlike New, existing sources are kept.
+func (pp *Policy) Append(name string, sources ...string) *Directive {
+	name = strings.ToLower(name)
+	d, ok := pp.dirs[name]
+	if !ok {
+		return pp.New(name, sources...)
+	}
+
+	if d == SelfDirective || d == NoneDirective {
+		d = d.clone()
+		pp.dirs[name] = d
+	}
+
+	d.Add(sources...)
+	return d
+}
+
+// RequireNonceOn adds the nonce placeholder to each named directive.
+// Missing directives are created.
+func (pp *Policy) RequireNonceOn(names ...string) *Policy {
+	for _, name := range names {
+		name = strings.ToLower(name)
+		d, ok := pp.dirs[name]
+		if !ok {
+			checkName(name)
+			d = &Directive{}
+			pp.setDir(name, d)
 		}
-	} else {
-		sb.WriteString(None)
+
+		d.RequireNonce()
 	}
+
+	pp.RequireNonce = len(names) > 0 || pp.RequireNonce
+	return pp
 }
 
-func (d *Directive) String() string {
-	var sb strings.Builder
-	d.write(&sb)
+// SetReporting sets ReportURI to uri and adds "report-to <group>" directive,
+// so browsers without Reporting API support fall back to report-uri.
+func (pp *Policy) SetReporting(uri string, group string) *Policy {
+	pp.ReportURI = uri
+	pp.New(ReportTo, group)
+	return pp
+}
 
-	return sb.String()
+// FrameAncestors sets frame-ancestors directive, replacing any existing one.
+// Defaults to 'none' when no sources are given, same as X-Frame-Options: DENY
+func (pp *Policy) FrameAncestors(sources ...string) *Policy {
+	if len(sources) == 0 {
+		sources = []string{None}
+	}
+
+	pp.New(FrameAncestors, sources...)
+	return pp
 }
 
-// Hash the source and appends to Sources
-func (d *Directive) Hash(ht HashType, source string) {
-	d.sources = append(d.sources, hash(ht, source))
+// XFrameOptions returns the X-Frame-Options header value equivalent to frame-ancestors.
+// Returns DENY for 'none', SAMEORIGIN for 'self', or "" if there is no legacy equivalent.
+func (pp *Policy) XFrameOptions() string {
+	d, ok := pp.dirs[FrameAncestors]
+	if !ok {
+		return ""
+	}
+
+	switch {
+	case len(d.sources) == 0, len(d.sources) == 1 && d.sources[0] == None:
+		return "DENY"
+	case len(d.sources) == 1 && d.sources[0] == Self:
+		return "SAMEORIGIN"
+	}
+
+	return ""
 }
 
-func hash(ht HashType, source string) string {
-	var (
-		hash []byte
-		sb   strings.Builder
-	)
+// EnableReportSample adds 'report-sample' once to each named directive, or to script-src and style-src if none given.
+// Missing directives are not created, since a directive with only 'report-sample' blocks everything.
+func (pp *Policy) EnableReportSample(names ...string) *Policy {
+	if len(names) == 0 {
+		names = []string{Script, Style}
+	}
 
-	switch ht {
-	case SHA256:
-		sb.Grow(53)
-		sb.WriteString("'sha256-")
-		h := sha256.Sum256([]byte(source))
-		hash = h[:]
-	case SHA384:
-		sb.Grow(73)
-		sb.WriteString("'sha384-")
-		h := sha512.Sum384([]byte(source))
-		hash = h[:]
-	case SHA512:
-		sb.Grow(97)
-		sb.WriteString("'sha512-")
-		h := sha512.Sum512([]byte(source))
-		hash = h[:]
-	default:
-		panic("invalid hashType")
+	for _, name := range names {
+		if d, ok := pp.dirs[strings.ToLower(name)]; ok && !d.Contains(ReportSample) {
+			d.Add(ReportSample)
+		}
 	}
 
-	sb.WriteString(base64.StdEncoding.EncodeToString(hash))
-	sb.WriteByte('\'')
-	return sb.String()
+	return pp
 }
 
-// Add appends sources to Sources
-func (d *Directive) Add(sources ...string) {
-	if d == SelfDirective || d == NoneDirective {
-		panic("immutable directive")
+// Has reports whether the policy defines directive name
+func (pp *Policy) Has(name string) bool {
+	_, ok := pp.dirs[strings.ToLower(name)]
+	return ok
+}
+
+// Get returns directive name, without creating it if absent
+func (pp *Policy) Get(name string) (*Directive, bool) {
+	d, ok := pp.dirs[strings.ToLower(name)]
+	return d, ok
+}
+
+// Remove directive from policy
+func (pp *Policy) Remove(name string) {
+	name = strings.ToLower(name)
+	pp.checkLocked(name)
+	pp.deleteDir(name)
+}
+
+// setDir sets directive name, tracking insertion order for Ordered. Panics if name is locked.
+func (pp *Policy) setDir(name string, d *Directive) {
+	pp.checkLocked(name)
+
+	if pp.dirs == nil {
+		pp.dirs = make(map[string]*Directive)
 	}
-	if d.sources == nil {
-		d.sources = make([]string, 0, len(sources))
+
+	if _, ok := pp.dirs[name]; !ok {
+		pp.order = append(pp.order, name)
+	}
+	pp.dirs[name] = d
+}
+
+// deleteDir removes directive name and its insertion order
+func (pp *Policy) deleteDir(name string) {
+	if _, ok := pp.dirs[name]; !ok {
+		return
 	}
 
-	for _, v := range sources {
-		if v == Nonce {
-			d.requireNonce = true
+	delete(pp.dirs, name)
+	for i, v := range pp.order {
+		if v == name {
+			pp.order = append(pp.order[:i:i], pp.order[i+1:]...)
 			break
 		}
 	}
-	d.sources = append(d.sources, sources...)
 }
 
-// Build policy into string
-func (pp *Policy) Build() string {
-	pp.Compiled = pp.MergeBuild(nil)
-	return pp.Compiled
+// LockDirective makes the named directive immutable. New, With and Remove panic for the name,
+// and modifying the directive sources panics. Locking an absent directive prevents adding it.
+func (pp *Policy) LockDirective(name string) *Policy {
+	name = strings.ToLower(name)
+
+	if d, ok := pp.dirs[name]; ok {
+		if d == SelfDirective || d == NoneDirective {
+			d = d.clone()
+			pp.dirs[name] = d
+		}
+		d.locked = true
+	}
+
+	if pp.locked == nil {
+		pp.locked = make(map[string]bool)
+	}
+	pp.locked[name] = true
+	return pp
 }
 
-func (pp *Policy) MergeBuild(dirs map[string]*Directive) string {
-	var (
-		sb   = &strings.Builder{}
-		size int
-	)
-	pp.RequireNonce = false
+// checkLocked panics if name is locked
+func (pp *Policy) checkLocked(name string) {
+	if pp.locked[name] {
+		panic("cspbuilder: locked directive " + name)
+	}
+}
 
-	if pp.UpgradeInsecureRequests {
-		size += len(upgradeInsecureRequests)
+// RemoveSourceEverywhere removes source from all directives and returns the count removed.
+// Directives left without sources are kept and emit 'none'. Locked directives are skipped.
+func (pp *Policy) RemoveSourceEverywhere(source string) int {
+	var n int
+
+	for _, d := range pp.dirs {
+		if !d.immutable() && d.Contains(source) {
+			n += d.Remove(source)
+		}
 	}
 
-	if pp.ReportURI != "" {
-		size += len(reportUri) + len(pp.ReportURI)
+	return n
+}
+
+// Compact removes sources equal to selfOrigin from directives that also contain 'self',
+// which already allows it. Origins are compared case-insensitively, ignoring a trailing slash.
+// Returns the count removed.
+func (pp *Policy) Compact(selfOrigin string) int {
+	var n int
+	selfOrigin = strings.TrimSuffix(selfOrigin, "/")
+
+	for _, d := range pp.dirs {
+		if d.immutable() || !d.Contains(Self) {
+			continue
+		}
+
+		sources := d.sources[:0]
+		for _, v := range d.sources {
+			if strings.EqualFold(strings.TrimSuffix(v, "/"), selfOrigin) {
+				n++
+				continue
+			}
+			sources = append(sources, v)
+		}
+		d.sources = sources
 	}
 
-	sb.Grow(size)
+	return n
+}
 
-	pp.writeDirs(sb, dirs)
+// Merge returns a new policy with directives of other appended to pp's.
+// 'none' is replaced by the sources of the other policy.
+// UpgradeInsecureRequests and BlockAllMixedContent are set if either policy sets it.
+// pp's ReportURI is kept unless empty. Locked directives stay locked in the new policy;
+// panics if other adds sources to a directive locked in either policy.
+func (pp *Policy) Merge(other *Policy) *Policy {
+	pol := &Policy{
+		dirs:                    make(map[string]*Directive, len(pp.dirs)+len(other.dirs)),
+		ReportURI:               pp.ReportURI,
+		ReportURIs:              pp.ReportURIs,
+		ReportEndpoints:         pp.ReportEndpoints,
+		ReportOnly:              pp.ReportOnly,
+		UpgradeInsecureRequests: pp.UpgradeInsecureRequests || other.UpgradeInsecureRequests,
+		BlockAllMixedContent:    pp.BlockAllMixedContent || other.BlockAllMixedContent,
+		Pretty:                  pp.Pretty,
+		TrailingSemicolon:       pp.TrailingSemicolon,
+		StripReportSample:       pp.StripReportSample,
+		Ordered:                 pp.Ordered,
+		RandReader:              pp.RandReader,
+		NonceEncoding:           pp.NonceEncoding,
+	}
 
-	if pp.UpgradeInsecureRequests {
-		sb.WriteString(upgradeInsecureRequests)
+	if len(pol.ReportEndpoints) == 0 {
+		pol.ReportEndpoints = other.ReportEndpoints
 	}
 
-	if pp.ReportURI != "" {
-		sb.WriteString(reportUri)
-		sb.WriteString(pp.ReportURI)
+	if pol.ReportURI == "" && len(pol.ReportURIs) == 0 {
+		pol.ReportURI = other.ReportURI
+		pol.ReportURIs = other.ReportURIs
 	}
 
-	compiled := sb.String()
-	if len(compiled) > 0 && compiled[len(compiled)-1:] == ";" {
-		compiled = compiled[:len(compiled)-1]
+	for _, name := range pp.order {
+		pol.setDir(name, pp.dirs[name].clone())
 	}
 
-	return compiled
-}
+	for _, name := range other.order {
+		d := other.dirs[name]
+		md, ok := pol.dirs[name]
 
-func (pp *Policy) writeDirs(sb *strings.Builder, dirs map[string]*Directive) {
+		// 'none' adds nothing, and is replaced by other sources
+		if ok && d.isNone() {
+			continue
+		}
 
-	// place default-src first for readability
-	/* if d, ok := pp.dirs[Default]; ok {
-		sb.WriteString(Default)
-		sb.WriteByte(' ')
-		d.write(sb)
+		if pp.locked[name] || ok && other.locked[name] {
+			panic("cspbuilder: locked directive " + name)
+		}
 
-		if dirs != nil {
-			if d, ok := dirs[Default]; ok {
-				sb.WriteByte(' ')
-				d.write(sb)
+		if ok {
+			md.Add(d.sources...)
+		} else {
+			pol.setDir(name, d.clone())
+		}
+	}
 
-				pp.RequireNonce = pp.RequireNonce || d.requireNonce
-			}
+	for _, locked := range []map[string]bool{pp.locked, other.locked} {
+		for name := range locked {
+			pol.LockDirective(name)
 		}
+	}
 
-		sb.WriteByte(';')
-		pp.RequireNonce = pp.RequireNonce || d.requireNonce
-	} */
+	return pol
+}
+
+// Equal reports whether both policies have the same directives, ignoring source order,
+// and the same report-uri, report-only and upgrade-insecure-requests settings.
+func (pp *Policy) Equal(other *Policy) bool {
+	if pp.UpgradeInsecureRequests != other.UpgradeInsecureRequests ||
+		pp.BlockAllMixedContent != other.BlockAllMixedContent ||
+		pp.ReportOnly != other.ReportOnly ||
+		pp.reportURIs() != other.reportURIs() ||
+		len(pp.dirs) != len(other.dirs) {
+		return false
+	}
 
 	for name, d := range pp.dirs {
-		/* if name == Default {
-			continue
-		} */
+		od, ok := other.dirs[name]
+		if !ok || !d.equal(od) {
+			return false
+		}
+	}
 
-		sb.WriteString(name)
-		sb.WriteByte(' ')
-		d.write(sb)
-		pp.RequireNonce = pp.RequireNonce || d.requireNonce
+	return true
+}
 
-		if dirs != nil {
-			if d, ok := dirs[name]; ok {
-				sb.WriteByte(' ')
-				d.write(sb)
+// Directives returns a shallow copy of the policy directives.
+// report-uri, upgrade-insecure-requests and block-all-mixed-content are stored in the ReportURI,
+// UpgradeInsecureRequests and BlockAllMixedContent fields, not in the returned map.
+func (pp *Policy) Directives() map[string]*Directive {
+	m := make(map[string]*Directive, len(pp.dirs))
 
-				pp.RequireNonce = pp.RequireNonce || d.requireNonce
-			}
+	for k, v := range pp.dirs {
+		m[k] = v
+	}
+
+	return m
+}
+
+// write directive.
+// Used by Policy.Build()
+func (d *Directive) write(sb policyWriter) {
+	if len(d.sources) > 0 {
+		if b, ok := sb.(*strings.Builder); ok {
+			b.Grow(d.size())
 		}
+		sb.WriteString(d.sources[0])
 
-		sb.WriteByte(';')
+		for i := 1; i < len(d.sources); i++ {
+			sb.WriteByte(' ')
+			sb.WriteString(d.sources[i])
+		}
+	} else {
+		sb.WriteString(None)
 	}
 }
 
-// WithNonce returns csp string with nonce
-func (pp *Policy) WithNonce(nonce *string) string {
-	var (
-		_b [16]byte
-		b  = _b[:]
-	)
-	if pp.Compiled == "" {
-		pp.Build()
+// size returns the length of the written directive sources
+func (d *Directive) size() int {
+	if len(d.sources) == 0 {
+		return len(None)
 	}
 
-	if !pp.RequireNonce {
-		return pp.Compiled
+	n := len(d.sources) - 1
+	for _, v := range d.sources {
+		n += len(v)
 	}
+	return n
+}
 
-	if _, err := rand.Read(b); err != nil {
-		panic("cspbuilder rand read failed")
+// sourceSet returns the directive sources as a set. Empty directive is 'none'
+func (d *Directive) sourceSet() map[string]bool {
+	if len(d.sources) == 0 {
+		return map[string]bool{None: true}
 	}
-	*nonce = base64.RawURLEncoding.EncodeToString(b)
 
-	return strings.ReplaceAll(pp.Compiled, Nonce, "'nonce-"+*nonce+"'")
+	m := make(map[string]bool, len(d.sources))
+	for _, v := range d.sources {
+		m[v] = true
+	}
+	return m
 }
 
-// Map exports directives as map[string]string.
-// Does not include nonce source.
-// Meant for middleware like gin-helmet that can only emit static csp strings
-func (pp *Policy) Map() map[string]string {
-	m := make(map[string]string, len(pp.dirs))
+// equal reports whether both directives have the same set of sources
+func (d *Directive) equal(o *Directive) bool {
+	a, b := d.sourceSet(), o.sourceSet()
+	if len(a) != len(b) {
+		return false
+	}
 
-	for k, v := range pp.dirs {
-		m[k] = v.String()
+	for v := range a {
+		if !b[v] {
+			return false
+		}
+	}
+	return true
+}
+
+// isNone reports whether the directive is written as 'none'
+func (d *Directive) isNone() bool {
+	return len(d.sources) == 0 || len(d.sources) == 1 && d.sources[0] == None
+}
+
+// immutable reports whether d is a shared global or locked directive
+func (d *Directive) immutable() bool {
+	return d == SelfDirective || d == NoneDirective || d.locked
+}
+
+// checkMutable panics if d is immutable
+func (d *Directive) checkMutable() {
+	if d.immutable() {
+		panic("immutable directive")
+	}
+}
+
+// clone returns a mutable copy of the directive
+func (d *Directive) clone() *Directive {
+	return &Directive{
+		sources:      append([]string(nil), d.sources...),
+		requireNonce: d.requireNonce,
+		Note:         d.Note,
+	}
+}
+
+// withoutNonce returns a copy of the directive without nonce placeholders
+func (d *Directive) withoutNonce() *Directive {
+	return d.without(Nonce)
+}
+
+// without returns a copy of the directive without source
+func (d *Directive) without(source string) *Directive {
+	nd := &Directive{
+		sources:      make([]string, 0, len(d.sources)),
+		requireNonce: d.requireNonce && source != Nonce,
+	}
+
+	for _, v := range d.sources {
+		if v != source {
+			nd.sources = append(nd.sources, v)
+		}
+	}
+
+	return nd
+}
+
+func (d *Directive) String() string {
+	var sb strings.Builder
+	d.write(&sb)
+
+	return sb.String()
+}
+
+// Hash the source and appends to Sources.
+// Panics on invalid hash type, use TryHash for hash types that are not constant
+func (d *Directive) Hash(ht HashType, source string) {
+	d.checkMutable()
+	d.sources = append(d.sources, hash(ht, source))
+}
+
+// AddEventHandlerHash hashes inline event handler or javascript: URL code and appends it to Sources,
+// adding 'unsafe-hashes' if not present so the hash applies to event handlers.
+func (d *Directive) AddEventHandlerHash(ht HashType, handlerCode string) {
+	if !d.Contains(UnsafeHashes) {
+		d.Add(UnsafeHashes)
+	}
+
+	d.Hash(ht, handlerCode)
+}
+
+// TryHash is Hash that returns ErrInvalidHashType instead of panicking
+func (d *Directive) TryHash(ht HashType, source string) error {
+	if !ht.Valid() {
+		return ErrInvalidHashType
+	}
+
+	d.Hash(ht, source)
+	return nil
+}
+
+// MatchesHash reports whether the ht hash of source is in Sources.
+// Hash sources are compared with crypto/subtle. Returns false on invalid hash type.
+func (d *Directive) MatchesHash(ht HashType, source string) bool {
+	if !ht.Valid() {
+		return false
+	}
+
+	h := []byte(hash(ht, source))
+	var match int
+
+	for _, v := range d.sources {
+		match |= subtle.ConstantTimeCompare(h, []byte(v))
+	}
+	return match == 1
+}
+
+// AddHashBytes appends a precomputed digest to Sources.
+// Returns an error if ht is invalid or the digest length does not match ht.
+func (d *Directive) AddHashBytes(ht HashType, digest []byte) error {
+	if !ht.Valid() {
+		return ErrInvalidHashType
+	}
+
+	d.checkMutable()
+
+	if len(digest) != int(ht)/8 {
+		return fmt.Errorf("cspbuilder: %d byte digest for %s", len(digest), ht.Prefix())
+	}
+
+	d.sources = append(d.sources, "'"+ht.Prefix()+"-"+base64.StdEncoding.EncodeToString(digest)+"'")
+	return nil
+}
+
+// HashAll hashes each source and appends them to Sources in order
+func (d *Directive) HashAll(ht HashType, sources ...string) {
+	d.checkMutable()
+
+	if cap(d.sources)-len(d.sources) < len(sources) {
+		ss := make([]string, len(d.sources), len(d.sources)+len(sources))
+		copy(ss, d.sources)
+		d.sources = ss
+	}
+
+	for _, v := range sources {
+		d.sources = append(d.sources, hash(ht, v))
+	}
+}
+
+// AddSRI appends the hashes of a subresource integrity value like "sha384-abc... sha512-def..." to Sources.
+// Returns an error without adding any hash if an algorithm is not sha256, sha384 or sha512.
+func (d *Directive) AddSRI(integrity string) error {
+	d.checkMutable()
+
+	fields := strings.Fields(integrity)
+	hashes := make([]string, 0, len(fields))
+
+	for _, v := range fields {
+		// strip SRI options
+		if i := strings.IndexByte(v, '?'); i >= 0 {
+			v = v[:i]
+		}
+
+		i := strings.IndexByte(v, '-')
+		if i < 0 || i == len(v)-1 {
+			return fmt.Errorf("cspbuilder: invalid SRI hash %q", v)
+		}
+
+		switch v[:i] {
+		case "sha256", "sha384", "sha512":
+		default:
+			return fmt.Errorf("cspbuilder: unsupported SRI algorithm %q", v[:i])
+		}
+
+		hashes = append(hashes, "'"+v+"'")
+	}
+
+	d.sources = append(d.sources, hashes...)
+	return nil
+}
+
+// Valid reports whether ht is a hash algorithm allowed in CSP: SHA256, SHA384 or SHA512
+func (ht HashType) Valid() bool {
+	switch ht {
+	case SHA256, SHA384, SHA512:
+		return true
+	}
+	return false
+}
+
+// Prefix returns the hash source algorithm name, e.g. sha256. Returns "" if ht is invalid.
+func (ht HashType) Prefix() string {
+	switch ht {
+	case SHA256:
+		return "sha256"
+	case SHA384:
+		return "sha384"
+	case SHA512:
+		return "sha512"
+	}
+	return ""
+}
+
+func hash(ht HashType, source string) string {
+	var (
+		hash []byte
+		sb   strings.Builder
+	)
+
+	switch ht {
+	case SHA256:
+		h := sha256.Sum256([]byte(source))
+		hash = h[:]
+	case SHA384:
+		h := sha512.Sum384([]byte(source))
+		hash = h[:]
+	case SHA512:
+		h := sha512.Sum512([]byte(source))
+		hash = h[:]
+	default:
+		panic("invalid hashType")
+	}
+
+	sb.Grow(len(ht.Prefix()) + base64.StdEncoding.EncodedLen(len(hash)) + 3)
+	sb.WriteByte('\'')
+	sb.WriteString(ht.Prefix())
+	sb.WriteByte('-')
+	sb.WriteString(base64.StdEncoding.EncodeToString(hash))
+	sb.WriteByte('\'')
+	return sb.String()
+}
+
+// Add appends sources to Sources.
+// 'none' is exclusive: adding None clears all other sources, and adding other sources
+// to a 'none' directive removes 'none'.
+func (d *Directive) Add(sources ...string) {
+	d.checkMutable()
+	if len(sources) == 0 {
+		return
+	}
+
+	var requireNonce bool
+	for _, v := range sources {
+		switch v {
+		case None:
+			d.sources = append(d.sources[:0], None)
+			d.requireNonce = false
+			return
+		case Nonce:
+			requireNonce = true
+		}
+	}
+
+	if d.sources == nil {
+		d.sources = make([]string, 0, len(sources))
+	} else if d.isNone() {
+		d.sources = d.sources[:0]
+	}
+
+	d.requireNonce = d.requireNonce || requireNonce
+	d.sources = append(d.sources, sources...)
+}
+
+// RequireNonce adds the nonce placeholder if absent. Calling it again has no effect.
+func (d *Directive) RequireNonce() {
+	if !d.Contains(Nonce) {
+		d.Add(Nonce)
+	}
+}
+
+// AddOrigin adds the scheme, host and port of rawurl, dropping path, query and fragment.
+// https is assumed for bare domains such as cdn.example.com.
+func (d *Directive) AddOrigin(rawurl string) error {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "https://" + rawurl
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("cspbuilder: invalid origin: %w", err)
+	}
+
+	if u.Host == "" {
+		return fmt.Errorf("cspbuilder: invalid origin %q: empty host", rawurl)
+	}
+
+	d.Add(strings.ToLower(u.Scheme + "://" + u.Host))
+	return nil
+}
+
+// AddSlice is Add with sources passed as a slice. sources is copied.
+func (d *Directive) AddSlice(sources []string) {
+	d.Add(sources...)
+}
+
+// Remove deletes all occurrences of source from Sources and returns the count removed
+func (d *Directive) Remove(source string) int {
+	d.checkMutable()
+
+	sources := d.sources[:0]
+	for _, v := range d.sources {
+		if v != source {
+			sources = append(sources, v)
+		}
+	}
+
+	n := len(d.sources) - len(sources)
+	d.sources = sources
+
+	if source == Nonce && n > 0 {
+		d.requireNonce = false
+	}
+	return n
+}
+
+// Normalize sorts sources into canonical order: hosts and schemes, keywords, then nonces and hashes.
+// Sources are sorted alphabetically within each group. No source is removed.
+func (d *Directive) Normalize() {
+	d.checkMutable()
+
+	sort.Slice(d.sources, func(i, j int) bool {
+		ri, rj := sourceRank(d.sources[i]), sourceRank(d.sources[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return d.sources[i] < d.sources[j]
+	})
+}
+
+// sourceRank orders sources for Normalize
+func sourceRank(source string) int {
+	switch {
+	case isNonceOrHash(source):
+		return 2
+	case strings.HasPrefix(source, "'"):
+		return 1
+	}
+	return 0
+}
+
+// Sources returns a copy of the directive sources
+func (d *Directive) Sources() []string {
+	if len(d.sources) == 0 {
+		return nil
+	}
+
+	sources := make([]string, len(d.sources))
+	copy(sources, d.sources)
+	return sources
+}
+
+// Contains reports whether source is in the directive sources
+func (d *Directive) Contains(source string) bool {
+	for _, v := range d.sources {
+		if v == source {
+			return true
+		}
+	}
+	return false
+}
+
+// Build policy into string.
+// RequireNonce is set only if the nonce placeholder is present in the compiled policy.
+func (pp *Policy) Build() string {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.buildState().compiled
+}
+
+// buildState builds the policy and stores its state. pp.mu must be held.
+func (pp *Policy) buildState() *compiledState {
+	st := &compiledState{
+		compiled:           pp.MergeBuild(nil),
+		nonceAt:            -1,
+		reportTo:           pp.ReportToHeader(),
+		reportingEndpoints: pp.ReportingEndpointsHeader(),
+		pol:                pp.Merge(&Policy{}),
+	}
+
+	n := strings.Count(st.compiled, Nonce)
+	if n == 1 {
+		st.nonceAt = strings.Index(st.compiled, Nonce)
+	}
+	st.requireNonce = n > 0
+
+	pp.Compiled = st.compiled
+	pp.RequireNonce = st.requireNonce
+	pp.state.Store(st)
+	return st
+}
+
+// compiled returns the state of the last Build(), building the policy once if it has not been built.
+// Safe for concurrent use.
+func (pp *Policy) compiled() *compiledState {
+	if st, _ := pp.state.Load().(*compiledState); st != nil {
+		return st
+	}
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if st, _ := pp.state.Load().(*compiledState); st != nil {
+		return st
+	}
+	return pp.buildState()
+}
+
+// Size returns the byte length of the compiled policy, building it if needed.
+// Nonce placeholders are counted as is.
+func (pp *Policy) Size() int {
+	if pp.Compiled == "" {
+		pp.Build()
+	}
+	return len(pp.Compiled)
+}
+
+// CompressedSize estimates the header cost after compression, as the DEFLATE compressed length
+// of the compiled policy. HPACK does not compress within a value this way, so treat it as a lower bound
+// useful for comparing policies, e.g. repeating a long host in many directives vs. default-src.
+func (pp *Policy) CompressedSize() int {
+	if pp.Compiled == "" {
+		pp.Build()
+	}
+
+	var cw countWriter
+	fw, _ := flate.NewWriter(&cw, flate.BestCompression)
+	io.WriteString(fw, pp.Compiled)
+	fw.Close()
+	return int(cw)
+}
+
+// countWriter counts the bytes written to it
+type countWriter int
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	*w += countWriter(len(p))
+	return len(p), nil
+}
+
+// Invalidate rebuilds the policy with changes made after Build(), e.g. a new ReportURI, and swaps it in
+// for middleware atomically: requests in flight finish with the previous policy, later requests use the new one.
+// Safe to call while requests are served, as long as the policy is changed only by the goroutine calling Invalidate.
+func (pp *Policy) Invalidate() {
+	pp.Build()
+}
+
+// MergeBuild returns the policy string with sources of dirs appended to the matching directives.
+// Directives that are 'none' are replaced instead, and locked directives are kept as is.
+// The policy is not modified.
+func (pp *Policy) MergeBuild(dirs map[string]*Directive) string {
+	return pp.build(dirs, pp.separator())
+}
+
+// String returns Compiled, or the compiled policy without modifying Compiled if Build() has not run
+func (pp *Policy) String() string {
+	if pp.Compiled != "" {
+		return pp.Compiled
+	}
+	return pp.MergeBuild(nil)
+}
+
+// WriteTo implements io.WriterTo, writing the compiled policy to w.
+// If Build() has not run, directives are written to w directly without modifying Compiled.
+func (pp *Policy) WriteTo(w io.Writer) (int64, error) {
+	if pp.Compiled != "" {
+		n, err := io.WriteString(w, pp.Compiled)
+		return int64(n), err
+	}
+
+	pw := &ioPolicyWriter{w: w}
+	pp.write(pw, nil, pp.separator())
+	return pw.n, pw.err
+}
+
+// AppendTo appends the compiled policy to b and returns the extended slice, building it if needed.
+// No allocation is made once built if b has capacity.
+func (pp *Policy) AppendTo(b []byte) []byte {
+	if pp.Compiled == "" {
+		pp.Build()
+	}
+	return append(b, pp.Compiled...)
+}
+
+// BuildOnly returns the policy string with only the named directives,
+// plus upgrade-insecure-requests and report-uri if set. Compiled is not modified.
+func (pp *Policy) BuildOnly(names ...string) string {
+	sub := &Policy{
+		dirs:                    make(map[string]*Directive, len(names)),
+		ReportURI:               pp.ReportURI,
+		ReportURIs:              pp.ReportURIs,
+		UpgradeInsecureRequests: pp.UpgradeInsecureRequests,
+		BlockAllMixedContent:    pp.BlockAllMixedContent,
+		Pretty:                  pp.Pretty,
+		TrailingSemicolon:       pp.TrailingSemicolon,
+		StripReportSample:       pp.StripReportSample && !pp.hasReporting(),
+		Ordered:                 pp.Ordered,
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if d, ok := pp.dirs[name]; ok {
+			sub.setDir(name, d)
+		}
+	}
+
+	return sub.MergeBuild(nil)
+}
+
+// BuildWith returns the policy string with directives separated by sep, e.g. ";\n" for nginx config.
+// Defaults to ";" when sep is empty. Compiled is not modified.
+func (pp *Policy) BuildWith(sep string) string {
+	if sep == "" {
+		sep = ";"
+	}
+	return pp.build(nil, sep)
+}
+
+func (pp *Policy) build(dirs map[string]*Directive, sep string) string {
+	sb := &strings.Builder{}
+	sb.Grow(pp.size(dirs, pp.reportURIs(), len(sep)))
+
+	pp.write(sb, dirs, sep)
+	return sb.String()
+}
+
+// write writes the policy to sb, with sources of dirs appended to the matching directives
+func (pp *Policy) write(sb policyWriter, dirs map[string]*Directive, sep string) {
+	reportURIs := pp.reportURIs()
+
+	pp.writeDirs(sb, dirs, sep)
+
+	if pp.UpgradeInsecureRequests {
+		writeSep(sb, sep)
+		sb.WriteString(upgradeInsecureRequests)
+	}
+
+	if pp.BlockAllMixedContent {
+		writeSep(sb, sep)
+		sb.WriteString(blockAllMixedContent)
+	}
+
+	if len(reportURIs) > 0 {
+		writeSep(sb, sep)
+		sb.WriteString(reportUri)
+		sb.WriteString(reportURIs)
+	}
+
+	if pp.TrailingSemicolon && sb.Len() > 0 {
+		sb.WriteByte(';')
+	}
+}
+
+// size returns the compiled policy length, used to Grow the builder once
+func (pp *Policy) size(dirs map[string]*Directive, reportURIs string, sepLen int) int {
+	var size int
+
+	for name, d := range pp.dirs {
+		size += sepLen + len(name) + 1 + d.size()
+
+		if md, ok := dirs[name]; ok {
+			size += 1 + md.size()
+		}
+	}
+
+	if pp.UpgradeInsecureRequests {
+		size += sepLen + len(upgradeInsecureRequests)
+	}
+
+	if pp.BlockAllMixedContent {
+		size += sepLen + len(blockAllMixedContent)
+	}
+
+	if len(reportURIs) > 0 {
+		size += sepLen + len(reportUri) + len(reportURIs)
+	}
+
+	if pp.TrailingSemicolon {
+		size++
+	}
+
+	return size
+}
+
+// separator returns the directive separator, "; " if Pretty
+func (pp *Policy) separator() string {
+	if pp.Pretty {
+		return "; "
+	}
+	return ";"
+}
+
+// policyWriter is the destination of a compiled policy, a *strings.Builder or *ioPolicyWriter
+type policyWriter interface {
+	io.StringWriter
+	io.ByteWriter
+	Len() int
+}
+
+// ioPolicyWriter writes to w, keeping the byte count and first error so the policy can be written without checks
+type ioPolicyWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+	b   [1]byte
+}
+
+func (pw *ioPolicyWriter) WriteString(s string) (int, error) {
+	if pw.err != nil {
+		return 0, pw.err
+	}
+
+	n, err := io.WriteString(pw.w, s)
+	pw.n += int64(n)
+	pw.err = err
+	return n, err
+}
+
+func (pw *ioPolicyWriter) WriteByte(c byte) error {
+	if pw.err != nil {
+		return pw.err
+	}
+
+	pw.b[0] = c
+	n, err := pw.w.Write(pw.b[:])
+	pw.n += int64(n)
+	pw.err = err
+	return err
+}
+
+func (pw *ioPolicyWriter) Len() int {
+	return int(pw.n)
+}
+
+// writeSep writes the directive separator unless sb is empty
+func writeSep(sb policyWriter, sep string) {
+	if sb.Len() > 0 {
+		sb.WriteString(sep)
+	}
+}
+
+// reportURIs joins ReportURI and ReportURIs with spaces
+func (pp *Policy) reportURIs() string {
+	if len(pp.ReportURIs) == 0 {
+		return pp.ReportURI
+	}
+
+	uris := pp.ReportURIs
+	if pp.ReportURI != "" {
+		uris = append([]string{pp.ReportURI}, uris...)
+	}
+
+	return strings.Join(uris, " ")
+}
+
+func (pp *Policy) writeDirs(sb policyWriter, dirs map[string]*Directive, sep string) {
+	strip := pp.StripReportSample && !pp.hasReporting()
+
+	if pp.Ordered {
+		for _, name := range pp.order {
+			writeDir(sb, name, stripReportSample(pp.dirs[name], strip), pp.mergeable(dirs, name), sep)
+		}
+		return
+	}
+
+	// place default-src first for readability
+	if d, ok := pp.dirs[Default]; ok {
+		writeDir(sb, Default, stripReportSample(d, strip), pp.mergeable(dirs, Default), sep)
+	}
+
+	for name, d := range pp.dirs {
+		if name == Default {
+			continue
+		}
+
+		writeDir(sb, name, stripReportSample(d, strip), pp.mergeable(dirs, name), sep)
+	}
+}
+
+// mergeable returns dirs, or nil if name is locked so merged sources cannot weaken it
+func (pp *Policy) mergeable(dirs map[string]*Directive, name string) map[string]*Directive {
+	if pp.locked[name] {
+		return nil
+	}
+	return dirs
+}
+
+// hasReporting reports whether the policy sends violation reports
+func (pp *Policy) hasReporting() bool {
+	if pp.reportURIs() != "" || len(pp.ReportEndpoints) > 0 {
+		return true
+	}
+
+	_, ok := pp.dirs[ReportTo]
+	return ok
+}
+
+// stripReportSample returns d without 'report-sample' if strip is set
+func stripReportSample(d *Directive, strip bool) *Directive {
+	if strip && d.Contains(ReportSample) {
+		return d.without(ReportSample)
+	}
+	return d
+}
+
+// writeDir writes directive name and sources, followed by sources of the matching merged directive.
+// A 'none' directive is replaced by the merged sources, since 'none' cannot be combined with other sources.
+func writeDir(sb policyWriter, name string, d *Directive, dirs map[string]*Directive, sep string) {
+	writeSep(sb, sep)
+	sb.WriteString(name)
+	sb.WriteByte(' ')
+
+	md, ok := dirs[name]
+	if !ok || len(md.sources) == 0 {
+		d.write(sb)
+		return
+	}
+
+	if !d.isNone() {
+		d.write(sb)
+		sb.WriteByte(' ')
+	}
+	md.write(sb)
+}
+
+// WithNonce returns csp string with nonce.
+// Panics if RandReader fails to return 16 bytes.
+func (pp *Policy) WithNonce(nonce *string) string {
+	s, _ := pp.WithNonceCount(nonce)
+	return s
+}
+
+// BuildNonce is WithNonce returning the nonce instead of using an out parameter.
+// nonce is empty if the policy does not require one.
+func (pp *Policy) BuildNonce() (policy string, nonce string) {
+	policy = pp.WithNonce(&nonce)
+	return policy, nonce
+}
+
+// WithNonceCount is WithNonce that also returns the number of nonce placeholders substituted.
+// The policy is written into a pooled buffer and copied to the returned string in one allocation;
+// nonce is a substring of it. Safe for concurrent use if RandReader is.
+func (pp *Policy) WithNonceCount(nonce *string) (string, int) {
+	st := pp.compiled()
+	if !st.requireNonce {
+		return st.compiled, 0
+	}
+
+	bp := noncePool.Get().(*[]byte)
+	defer putNonceBuf(bp)
+
+	r, enc := pp.nonceSource()
+
+	var (
+		nonceLen = enc.EncodedLen(nonceRawLen)
+		head     = nonceRawLen + nonceLen
+	)
+
+	// buf holds the raw nonce bytes, the encoded nonce, then the policy
+	need := head + len(st.compiled) + strings.Count(st.compiled, Nonce)*(len("'nonce-'")+nonceLen-len(Nonce))
+	buf := *bp
+	if cap(buf) < need {
+		buf = make([]byte, 0, need)
+		*bp = buf
+	}
+	buf = buf[:head]
+
+	if _, err := io.ReadFull(r, buf[:nonceRawLen]); err != nil {
+		panic("cspbuilder rand read failed")
+	}
+	enc.Encode(buf[nonceRawLen:head], buf[:nonceRawLen])
+
+	var (
+		compiled = st.compiled
+		at       = -1
+		n        int
+	)
+
+	if st.nonceAt >= 0 {
+		buf = appendNonce(buf, compiled[:st.nonceAt], head, &at)
+		compiled = compiled[st.nonceAt+len(Nonce):]
+		n = 1
+	} else {
+		for {
+			i := strings.Index(compiled, Nonce)
+			if i < 0 {
+				break
+			}
+
+			buf = appendNonce(buf, compiled[:i], head, &at)
+			compiled = compiled[i+len(Nonce):]
+			n++
+		}
+	}
+
+	buf = append(buf, compiled...)
+
+	s := string(buf[head:])
+	*nonce = s[at : at+nonceLen]
+	return s, n
+}
+
+const (
+	// nonceRawLen is the nonce size in bytes before encoding
+	nonceRawLen = 16
+
+	// maxPooledNonceBuf keeps unusually large buffers out of noncePool
+	maxPooledNonceBuf = 64 << 10
+)
+
+// noncePool holds WithNonceCount buffers. sync.Pool is safe for concurrent use;
+// each buffer is used by one call at a time.
+var noncePool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// putNonceBuf zeroes the raw nonce bytes and returns bp to noncePool
+func putNonceBuf(bp *[]byte) {
+	b := *bp
+	if cap(b) > maxPooledNonceBuf {
+		return
+	}
+
+	b = b[:nonceRawLen]
+	for i := range b {
+		b[i] = 0
+	}
+
+	*bp = b[:0]
+	noncePool.Put(bp)
+}
+
+// appendNonce appends prefix and the nonce source encoded at buf[nonceRawLen:head].
+// *at is set to the nonce offset within the policy on first call.
+func appendNonce(buf []byte, prefix string, head int, at *int) []byte {
+	buf = append(buf, prefix...)
+	buf = append(buf, "'nonce-"...)
+
+	if *at < 0 {
+		*at = len(buf) - head
+	}
+
+	buf = append(buf, buf[nonceRawLen:head]...)
+	return append(buf, '\'')
+}
+
+// NoncePlaceholderCount returns the number of nonce placeholders in the compiled policy,
+// building it if needed. No nonce is generated.
+func (pp *Policy) NoncePlaceholderCount() int {
+	if pp.Compiled == "" {
+		pp.Build()
+	}
+	return strings.Count(pp.Compiled, Nonce)
+}
+
+// WithFixedNonce returns csp string with the nonce placeholders replaced by 'nonce-<nonce>'.
+// Meant for tests and snapshots; use WithNonce in production.
+// Panics if the policy has no nonce placeholder.
+func (pp *Policy) WithFixedNonce(nonce string) string {
+	if pp.NoncePlaceholderCount() == 0 {
+		panic("cspbuilder: WithFixedNonce policy has no nonce placeholder")
+	}
+
+	return strings.ReplaceAll(pp.Compiled, Nonce, "'nonce-"+nonce+"'")
+}
+
+// NewNonce returns a random base64 encoded 128-bit nonce from crypto/rand.
+// Panics if crypto/rand fails.
+func NewNonce() string {
+	return newNonce(nil)
+}
+
+// NewNonce returns a random 128-bit nonce from RandReader encoded with NonceEncoding,
+// for nonces substituted into the policy later, e.g. by SetHeader.
+// Panics if RandReader fails to return 16 bytes.
+func (pp *Policy) NewNonce() string {
+	return newNonce(pp)
+}
+
+// newNonce returns a random 128-bit nonce from the RandReader and NonceEncoding of pp, which may be nil
+func newNonce(pp *Policy) string {
+	var (
+		_b     [nonceRawLen]byte
+		b      = _b[:]
+		r, enc = pp.nonceSource()
+	)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		panic("cspbuilder rand read failed")
+	}
+	return enc.EncodeToString(b)
+}
+
+// nonceSource returns RandReader and NonceEncoding, or their defaults if unset or pp is nil
+func (pp *Policy) nonceSource() (io.Reader, *base64.Encoding) {
+	var (
+		r   io.Reader = rand.Reader
+		enc           = base64.RawURLEncoding
+	)
+
+	if pp != nil && pp.RandReader != nil {
+		r = pp.RandReader
+	}
+
+	if pp != nil && pp.NonceEncoding != nil {
+		enc = pp.NonceEncoding
+	}
+
+	return r, enc
+}
+
+// Map exports directives as map[string]string.
+// Nonce placeholders are removed; a directive left without sources maps to 'none'.
+// upgrade-insecure-requests maps to "" and report-uri to its endpoints when set.
+// Meant for middleware like gin-helmet that can only emit static csp strings
+func (pp *Policy) Map() map[string]string {
+	return pp.MapExcluding()
+}
+
+// MapExcluding is Map without the named directives,
+// e.g. report-to that some middleware cannot handle.
+func (pp *Policy) MapExcluding(names ...string) map[string]string {
+	m := make(map[string]string, len(pp.dirs)+2)
+
+	for k, v := range pp.dirs {
+		if v.requireNonce {
+			v = v.withoutNonce()
+		}
+		m[k] = v.String()
+	}
+
+	if pp.UpgradeInsecureRequests {
+		m[upgradeInsecureRequests] = ""
+	}
+
+	if pp.BlockAllMixedContent {
+		m[blockAllMixedContent] = ""
+	}
+
+	if reportURIs := pp.reportURIs(); reportURIs != "" {
+		m[strings.TrimSpace(reportUri)] = reportURIs
+	}
+
+	for _, name := range names {
+		delete(m, strings.ToLower(name))
 	}
 
 	return m
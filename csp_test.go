@@ -1,6 +1,14 @@
 package cspbuilder_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
 	"strings"
 	"testing"
 
@@ -104,8 +112,26 @@ func TestMerge(t *testing.T) {
 
 	t.Log(s)
 
-	if !strings.Contains(pol.Compiled, want) {
-		t.Fatal("want", want, "got", pol.Compiled)
+	if !strings.Contains(s, want) {
+		t.Fatal("want", want, "got", s)
+	}
+}
+
+func TestMergeBuildUnchanged(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.RequireNonce = true
+
+	d := &cspbuilder.Directive{}
+	d.Add(cspbuilder.Nonce)
+
+	s := pol.MergeBuild(map[string]*cspbuilder.Directive{cspbuilder.Script: d})
+	if s != "script-src 'self' $NONCE" {
+		t.Fatal("want script-src 'self' $NONCE got", s)
+	}
+
+	if !pol.RequireNonce || pol.Compiled != "" {
+		t.Fatal("MergeBuild modified policy", pol.RequireNonce, pol.Compiled)
 	}
 }
 
@@ -147,8 +173,2077 @@ func BenchmarkNonceCsp(b *testing.B) {
 	pol := setup(1)
 	pol.Build()
 
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		var nonce string
+		pol.WithNonce(&nonce)
+	}
+}
+
+func TestNonceAllocs(t *testing.T) {
+	var nonce string
+
+	pol := setup(1)
+	pol.Build()
+
+	if n := testing.AllocsPerRun(100, func() { pol.WithNonce(&nonce) }); n != 1 {
+		t.Fatal("want 1 alloc got", n)
+	}
+
+	pol.New(cspbuilder.Style, cspbuilder.Nonce)
+	pol.Build()
+
+	if n := testing.AllocsPerRun(100, func() { pol.WithNonce(&nonce) }); n != 1 {
+		t.Fatal("want 1 alloc got", n)
+	}
+
+	s := pol.WithNonce(&nonce)
+	if len(nonce) != 22 || strings.Count(s, "'nonce-"+nonce+"'") != 2 {
+		t.Fatal("want 2 nonce", nonce, "got", s)
+	}
+}
+
+func TestRandReader(t *testing.T) {
+	var (
+		nonce string
+		pol   = cspbuilder.New()
+	)
+
+	pol.New(cspbuilder.Script, cspbuilder.Nonce)
+	pol.RandReader = bytes.NewReader(make([]byte, 16))
+
+	s := pol.WithNonce(&nonce)
+
+	if nonce != "AAAAAAAAAAAAAAAAAAAAAA" {
+		t.Fatal("want AAAAAAAAAAAAAAAAAAAAAA got", nonce)
+	}
+
+	if s != "script-src 'nonce-AAAAAAAAAAAAAAAAAAAAAA'" {
+		t.Fatal("want script-src 'nonce-AAAAAAAAAAAAAAAAAAAAAA' got", s)
+	}
+}
+
+func TestSources(t *testing.T) {
+	d := &cspbuilder.Directive{}
+
+	if src := d.Sources(); len(src) != 0 {
+		t.Fatal("want empty sources got", src)
+	}
+
+	if d.Contains(cspbuilder.Self) {
+		t.Fatal("empty directive contains 'self'")
+	}
+
+	d.Add(cspbuilder.Self, "cdn.example.com")
+
+	src := d.Sources()
+	if len(src) != 2 || src[0] != cspbuilder.Self || src[1] != "cdn.example.com" {
+		t.Fatal("want ['self' cdn.example.com] got", src)
+	}
+
+	// modifying the copy must not change the directive
+	src[0] = cspbuilder.None
+	if !d.Contains(cspbuilder.Self) || d.Contains(cspbuilder.None) {
+		t.Fatal("Sources() exposed internal slice", d.String())
+	}
+
+	if !d.Contains("cdn.example.com") || d.Contains("example.com") {
+		t.Fatal("Contains mismatch", d.String())
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	pol := cspbuilder.Starter()
+	pol.ReportURI = "/_csp-report"
+	pol.UpgradeInsecureRequests = true
+
+	m := pol.Directives()
+
+	if len(m) != 8 {
+		t.Fatal("want 8 directives got", len(m))
+	}
+
+	if _, ok := m["report-uri"]; ok {
+		t.Fatal("report-uri must not be in directives map")
+	}
+
+	delete(m, cspbuilder.Script)
+
+	if _, ok := pol.Directives()[cspbuilder.Script]; !ok {
+		t.Fatal("Directives() exposed internal map")
+	}
+}
+
+func TestReportURIs(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.ReportURIs = []string{"/a", "/b"}
+
+	if s := pol.Build(); s != "report-uri /a /b" {
+		t.Fatal("want report-uri /a /b got", s)
+	}
+
+	pol.ReportURI = "/_csp-report"
+
+	if s := pol.Build(); s != "report-uri /_csp-report /a /b" {
+		t.Fatal("want report-uri /_csp-report /a /b got", s)
+	}
+}
+
+func TestSeparators(t *testing.T) {
+	tests := []struct {
+		upgrade   bool
+		reportURI string
+		want      string
+	}{
+		{false, "", "script-src 'self'"},
+		{true, "", "script-src 'self';upgrade-insecure-requests"},
+		{false, "/x", "script-src 'self';report-uri /x"},
+		{true, "/x", "script-src 'self';upgrade-insecure-requests;report-uri /x"},
+	}
+
+	for _, test := range tests {
+		pol := cspbuilder.New()
+		pol.New(cspbuilder.Script, cspbuilder.Self)
+		pol.UpgradeInsecureRequests = test.upgrade
+		pol.ReportURI = test.reportURI
+
+		if s := pol.Build(); s != test.want {
+			t.Fatal("want", test.want, "got", s)
+		}
+	}
+
+	pol := cspbuilder.New()
+	pol.UpgradeInsecureRequests = true
+	pol.ReportURI = "/x"
+
+	if s := pol.Build(); s != "upgrade-insecure-requests;report-uri /x" {
+		t.Fatal("want upgrade-insecure-requests;report-uri /x got", s)
+	}
+}
+
+func TestPretty(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.None)
+	pol.UpgradeInsecureRequests = true
+
+	if s := pol.Build(); s != "default-src 'none';upgrade-insecure-requests" {
+		t.Fatal("want default-src 'none';upgrade-insecure-requests got", s)
+	}
+
+	pol.Pretty = true
+
+	if s := pol.Build(); s != "default-src 'none'; upgrade-insecure-requests" {
+		t.Fatal("want default-src 'none'; upgrade-insecure-requests got", s)
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	a := cspbuilder.New()
+	a.New(cspbuilder.Script, cspbuilder.Self)
+	a.New(cspbuilder.Img, cspbuilder.Self)
+
+	b := cspbuilder.New()
+	b.New(cspbuilder.Script, "cdn.example.com", cspbuilder.Nonce)
+	b.New(cspbuilder.Font, "fonts.gstatic.com")
+	b.UpgradeInsecureRequests = true
+	b.ReportURI = "/_csp-report"
+
+	pol := a.Merge(b)
+	pol.Build()
+
+	for _, want := range []string{
+		"script-src 'self' cdn.example.com $NONCE",
+		"img-src 'self'",
+		"font-src fonts.gstatic.com",
+		"upgrade-insecure-requests",
+		"report-uri /_csp-report",
+	} {
+		if !strings.Contains(pol.Compiled, want) {
+			t.Fatal("want", want, "got", pol.Compiled)
+		}
+	}
+
+	if !pol.RequireNonce {
+		t.Fatal("RequireNonce = false")
+	}
+
+	// inputs are unchanged
+	if s := a.Build(); strings.Contains(s, "cdn.example.com") || strings.Contains(s, "font-src") || a.UpgradeInsecureRequests {
+		t.Fatal("Merge mutated receiver", s)
+	}
+
+	if s := b.Build(); strings.Contains(s, "'self'") {
+		t.Fatal("Merge mutated other", s)
+	}
+}
+
+func TestStarterMutable(t *testing.T) {
+	pol := cspbuilder.Starter()
+	pol.Directives()[cspbuilder.Script].Add("cdn.example.com")
+
+	if s := pol.Build(); !strings.Contains(s, "script-src 'self' cdn.example.com") {
+		t.Fatal("want script-src 'self' cdn.example.com got", s)
+	}
+
+	if s := cspbuilder.Starter().Build(); strings.Contains(s, "cdn.example.com") {
+		t.Fatal("Starter() directives are shared", s)
+	}
+
+	if s := cspbuilder.SelfDirective.String(); s != cspbuilder.Self {
+		t.Fatal("SelfDirective modified", s)
+	}
+}
+
+func TestValidateStrictDynamic(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.StrictDynamic, "cdn.example.com", cspbuilder.Nonce)
+
+	w := pol.Validate()
+	if len(w) != 1 || w[0].Directive != cspbuilder.Script || !strings.Contains(w[0].Message, "cdn.example.com") {
+		t.Fatal("want 1 warning for cdn.example.com got", w)
+	}
+
+	// validate must not rewrite the policy
+	if s := pol.Build(); s != "script-src 'strict-dynamic' cdn.example.com $NONCE" {
+		t.Fatal("want script-src 'strict-dynamic' cdn.example.com $NONCE got", s)
+	}
+
+	pol.New(cspbuilder.Script, cspbuilder.StrictDynamic, cspbuilder.Nonce)
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+}
+
+func TestRequireNonceOn(t *testing.T) {
+	var nonce string
+
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.RequireNonceOn(cspbuilder.Script, cspbuilder.Style)
+
+	if !pol.RequireNonce {
+		t.Fatal("RequireNonce = false")
+	}
+
+	pol.Build()
+
+	for _, want := range []string{"script-src 'self' $NONCE", "style-src $NONCE"} {
+		if !strings.Contains(pol.Compiled, want) {
+			t.Fatal("want", want, "got", pol.Compiled)
+		}
+	}
+
+	s := pol.WithNonce(&nonce)
+	if strings.Contains(s, cspbuilder.Nonce) || strings.Count(s, "'nonce-"+nonce+"'") != 2 {
+		t.Fatal("want 2 nonces got", s)
+	}
+}
+
+func TestWithNonceCount(t *testing.T) {
+	var nonce string
+
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+	pol.New(cspbuilder.Style, cspbuilder.Nonce)
+	pol.New(cspbuilder.Img, cspbuilder.Self)
+
+	s, n := pol.WithNonceCount(&nonce)
+	if n != 2 || strings.Count(s, "'nonce-"+nonce+"'") != 2 || strings.Contains(s, cspbuilder.Nonce) {
+		t.Fatal("want 2 substitutions got", n, s)
+	}
+
+	pol = cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+
+	if s, n := pol.WithNonceCount(&nonce); n != 0 || s != "script-src 'self'" {
+		t.Fatal("want 0 substitutions got", n, s)
+	}
+}
+
+func TestRequireNonceRecomputed(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+	pol.Build()
+
+	if !pol.RequireNonce {
+		t.Fatal("RequireNonce = false")
+	}
+
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.RequireNonce = true
+	pol.Build()
+
+	if pol.RequireNonce {
+		t.Fatal("RequireNonce = true without placeholder", pol.Compiled)
+	}
+}
+
+func TestTrustedTypes(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.TrustedTypes, "myPolicy", cspbuilder.TrustedTypesAllowDuplicates)
+
+	if s := pol.Build(); s != "trusted-types myPolicy 'allow-duplicates'" {
+		t.Fatal("want trusted-types myPolicy 'allow-duplicates' got", s)
+	}
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+
+	pol.New(cspbuilder.TrustedTypes, "'myPolicy'")
+
+	if w := pol.Validate(); len(w) != 1 {
+		t.Fatal("want 1 warning got", w)
+	}
+}
+
+func TestHashAll(t *testing.T) {
+	scripts := []string{`doSomething()`, `doAnother()`, `doMore()`}
+
+	want := &cspbuilder.Directive{}
+	for _, v := range scripts {
+		want.Hash(cspbuilder.SHA256, v)
+	}
+
+	d := &cspbuilder.Directive{}
+	d.HashAll(cspbuilder.SHA256, scripts...)
+
+	if d.String() != want.String() || len(d.Sources()) != 3 {
+		t.Fatal("want", want.String(), "got", d.String())
+	}
+}
+
+func BenchmarkBuild(b *testing.B) {
+	pol := cspbuilder.Starter()
+	pol.New(cspbuilder.Script, cspbuilder.Self, "cdnjs.cloudflare.com", "cdn.jsdelivr.net", cspbuilder.Nonce)
+	pol.New(cspbuilder.Font, "fonts.googleapis.com", "fonts.gstatic.com")
+	pol.UpgradeInsecureRequests = true
+	pol.ReportURI = "/_csp-report"
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		pol.Build()
+	}
+}
+
+func BenchmarkNonceMultiCsp(b *testing.B) {
+	pol := setup(1)
+	pol.New(cspbuilder.Style, cspbuilder.Nonce)
+	pol.Build()
+
+	b.ReportAllocs()
+
 	for i := 0; i < b.N; i++ {
 		var nonce string
 		pol.WithNonce(&nonce)
 	}
 }
+
+func TestMap(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+
+	m := pol.Map()
+	if len(m) != 1 || m[cspbuilder.Script] != cspbuilder.Self {
+		t.Fatal("want map[script-src:'self'] got", m)
+	}
+
+	pol.UpgradeInsecureRequests = true
+	pol.ReportURI = "/_csp-report"
+
+	m = pol.Map()
+	if v, ok := m["upgrade-insecure-requests"]; !ok || v != "" {
+		t.Fatal("want upgrade-insecure-requests got", m)
+	}
+
+	if m["report-uri"] != "/_csp-report" {
+		t.Fatal("want report-uri /_csp-report got", m)
+	}
+}
+
+func TestMapWithoutNonce(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce, cspbuilder.StrictDynamic)
+	pol.New(cspbuilder.Style, cspbuilder.Nonce)
+
+	m := pol.Map()
+	for k, v := range m {
+		if strings.Contains(v, cspbuilder.Nonce) {
+			t.Fatal(k, "contains nonce placeholder", v)
+		}
+	}
+
+	if m[cspbuilder.Script] != "'self' 'strict-dynamic'" || m[cspbuilder.Style] != cspbuilder.None {
+		t.Fatal("unexpected map", m)
+	}
+
+	if s := pol.Build(); !strings.Contains(s, cspbuilder.Nonce) {
+		t.Fatal("Map() modified policy", s)
+	}
+}
+
+func TestValidateScheme(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Connect, cspbuilder.Self, cspbuilder.HTTPS, cspbuilder.WSS, "wss://ws.example.com")
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+
+	if s := pol.Build(); s != "connect-src 'self' https: wss: wss://ws.example.com" {
+		t.Fatal("want connect-src 'self' https: wss: wss://ws.example.com got", s)
+	}
+
+	pol.New(cspbuilder.Connect, "https://")
+
+	if w := pol.Validate(); len(w) != 1 || !strings.Contains(w[0].Message, "https:") {
+		t.Fatal("want 1 warning got", w)
+	}
+}
+
+func TestAddSRI(t *testing.T) {
+	d := &cspbuilder.Directive{}
+
+	err := d.AddSRI("sha384-oqVuAfXRKap7fdgcCY5uykM6+R9GqQ8K/uxy9rx7HNQlGYl1kPzQho1wx4JwY8wC sha512-NrS2FABurNzIW2yTKRxF8X+HMhJh29vd9syOLut1MW4Cd1JeGzZqughLzC+LQr0O8XFhCuR4zyjLgrTQct7jAA==")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "'sha384-oqVuAfXRKap7fdgcCY5uykM6+R9GqQ8K/uxy9rx7HNQlGYl1kPzQho1wx4JwY8wC' 'sha512-NrS2FABurNzIW2yTKRxF8X+HMhJh29vd9syOLut1MW4Cd1JeGzZqughLzC+LQr0O8XFhCuR4zyjLgrTQct7jAA=='"
+	if d.String() != want {
+		t.Fatal("want", want, "got", d.String())
+	}
+
+	d = &cspbuilder.Directive{}
+	if err := d.AddSRI("sha256-abc md5-def"); err == nil {
+		t.Fatal("want error for md5")
+	}
+
+	if len(d.Sources()) != 0 {
+		t.Fatal("want no sources got", d.Sources())
+	}
+}
+
+func TestRemoveSourceEverywhere(t *testing.T) {
+	pol := cspbuilder.Starter()
+	pol.New(cspbuilder.Script, cspbuilder.Self, "ads.example.com")
+	pol.New(cspbuilder.Connect, "ads.example.com")
+
+	if n := pol.RemoveSourceEverywhere("ads.example.com"); n != 2 {
+		t.Fatal("want 2 removed got", n)
+	}
+
+	pol.Build()
+
+	if strings.Contains(pol.Compiled, "ads.example.com") {
+		t.Fatal("source not removed", pol.Compiled)
+	}
+
+	for _, want := range []string{"script-src 'self'", "connect-src 'none'"} {
+		if !strings.Contains(pol.Compiled, want) {
+			t.Fatal("want", want, "got", pol.Compiled)
+		}
+	}
+
+	if n := pol.RemoveSourceEverywhere("ads.example.com"); n != 0 {
+		t.Fatal("want 0 removed got", n)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.Self)
+	pol.New(cspbuilder.Img, cspbuilder.All)
+
+	if l := pol.Level(); l != 1 {
+		t.Fatal("want level 1 got", l)
+	}
+
+	pol.New(cspbuilder.FrameAncestors, cspbuilder.None)
+
+	if l := pol.Level(); l != 2 {
+		t.Fatal("want level 2 got", l)
+	}
+
+	pol.New(cspbuilder.Script, cspbuilder.Nonce, cspbuilder.StrictDynamic)
+
+	if l := pol.Level(); l != 3 {
+		t.Fatal("want level 3 got", l)
+	}
+
+	pol = cspbuilder.New()
+	pol.New(cspbuilder.TrustedTypes, "myPolicy")
+
+	if l := pol.Level(); l != 3 {
+		t.Fatal("want level 3 got", l)
+	}
+
+	pol = cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self).Hash(cspbuilder.SHA256, `doSomething()`)
+
+	if l := pol.Level(); l != 2 {
+		t.Fatal("want level 2 got", l)
+	}
+}
+
+func TestValidateUnsafeInline(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.UnsafeInline, cspbuilder.Nonce)
+
+	w := pol.Validate()
+	if len(w) != 1 || w[0].Directive != cspbuilder.Script || !strings.Contains(w[0].Message, cspbuilder.UnsafeInline) {
+		t.Fatal("want 1 warning for 'unsafe-inline' got", w)
+	}
+
+	pol.New(cspbuilder.Style, cspbuilder.UnsafeInline).Hash(cspbuilder.SHA256, `body{}`)
+
+	if w := pol.Validate(); len(w) != 2 {
+		t.Fatal("want 2 warnings got", w)
+	}
+
+	if s := pol.Build(); !strings.Contains(s, "script-src 'unsafe-inline' $NONCE") {
+		t.Fatal("Validate() modified policy", s)
+	}
+
+	pol = cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.UnsafeInline, cspbuilder.Self)
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+}
+
+func TestSetReporting(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.Self)
+	pol.SetReporting("/_csp-report", "csp-endpoint")
+	pol.Build()
+
+	for _, want := range []string{"report-to csp-endpoint", "report-uri /_csp-report"} {
+		if !strings.Contains(pol.Compiled, want) {
+			t.Fatal("want", want, "got", pol.Compiled)
+		}
+	}
+}
+
+func TestFrameAncestors(t *testing.T) {
+	pol := cspbuilder.New()
+
+	if x := pol.XFrameOptions(); x != "" {
+		t.Fatal("want empty X-Frame-Options got", x)
+	}
+
+	pol.FrameAncestors()
+
+	if s := pol.Build(); s != "frame-ancestors 'none'" {
+		t.Fatal("want frame-ancestors 'none' got", s)
+	}
+
+	if x := pol.XFrameOptions(); x != "DENY" {
+		t.Fatal("want DENY got", x)
+	}
+
+	pol.FrameAncestors(cspbuilder.Self)
+
+	if x := pol.XFrameOptions(); x != "SAMEORIGIN" {
+		t.Fatal("want SAMEORIGIN got", x)
+	}
+
+	pol.FrameAncestors(cspbuilder.Self, "https://partner.example.com")
+
+	if s := pol.Build(); s != "frame-ancestors 'self' https://partner.example.com" {
+		t.Fatal("want frame-ancestors 'self' https://partner.example.com got", s)
+	}
+
+	if x := pol.XFrameOptions(); x != "" {
+		t.Fatal("want empty X-Frame-Options got", x)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := cspbuilder.New()
+	a.New(cspbuilder.Script, cspbuilder.Self, "cdn.example.com", cspbuilder.Nonce)
+	a.New(cspbuilder.Img, cspbuilder.Self)
+	a.ReportURI = "/_csp-report"
+
+	b := cspbuilder.New()
+	b.New(cspbuilder.Img, cspbuilder.Self)
+	b.New(cspbuilder.Script, cspbuilder.Nonce, "cdn.example.com", cspbuilder.Self)
+	b.ReportURI = "/_csp-report"
+
+	if !a.Equal(b) || !b.Equal(a) {
+		t.Fatal("want equal", a.Build(), b.Build())
+	}
+
+	b.UpgradeInsecureRequests = true
+	if a.Equal(b) {
+		t.Fatal("want not equal on upgrade-insecure-requests")
+	}
+	b.UpgradeInsecureRequests = false
+
+	b.New(cspbuilder.Img, cspbuilder.All)
+	if a.Equal(b) {
+		t.Fatal("want not equal", a.Build(), b.Build())
+	}
+
+	b.New(cspbuilder.Img, cspbuilder.Self)
+	b.New(cspbuilder.Font, cspbuilder.Self)
+	if a.Equal(b) {
+		t.Fatal("want not equal", a.Build(), b.Build())
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := cspbuilder.New()
+	a.New(cspbuilder.Img, "old.cdn.com")
+	a.New(cspbuilder.Style, cspbuilder.Self, "fonts.googleapis.com")
+	a.New(cspbuilder.Default, cspbuilder.None)
+
+	b := cspbuilder.New()
+	b.New(cspbuilder.Script, "cdn.new.com")
+	b.New(cspbuilder.Style, cspbuilder.Self, cspbuilder.UnsafeInline)
+	b.New(cspbuilder.Default, cspbuilder.None)
+	b.UpgradeInsecureRequests = true
+
+	want := []string{
+		"- img-src old.cdn.com",
+		"+ script-src cdn.new.com",
+		"~ style-src: +'unsafe-inline' -fonts.googleapis.com",
+		"+ upgrade-insecure-requests",
+	}
+
+	got := cspbuilder.Diff(a, b)
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatal("want", want, "got", got)
+	}
+
+	if d := cspbuilder.Diff(a, a); len(d) != 0 {
+		t.Fatal("want no diff got", d)
+	}
+}
+
+func TestWasmUnsafeEval(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.WasmUnsafeEval)
+
+	if s := pol.Build(); s != "script-src 'self' 'wasm-unsafe-eval'" {
+		t.Fatal("want script-src 'self' 'wasm-unsafe-eval' got", s)
+	}
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+
+	pol.New(cspbuilder.Script, cspbuilder.Self, "'wasm-eval'")
+
+	if w := pol.Validate(); len(w) != 1 || !strings.Contains(w[0].Message, "not a known keyword") {
+		t.Fatal("want unknown keyword warning got", w)
+	}
+}
+
+func TestTryHash(t *testing.T) {
+	d := &cspbuilder.Directive{}
+
+	if err := d.TryHash(cspbuilder.HashType(123), `doSomething()`); err != cspbuilder.ErrInvalidHashType {
+		t.Fatal("want ErrInvalidHashType got", err)
+	}
+
+	if len(d.Sources()) != 0 {
+		t.Fatal("want no sources got", d.Sources())
+	}
+
+	if err := d.TryHash(cspbuilder.SHA512, `doSomething()`); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := d.String(); s != "'sha512-NrS2FABurNzIW2yTKRxF8X+HMhJh29vd9syOLut1MW4Cd1JeGzZqughLzC+LQr0O8XFhCuR4zyjLgrTQct7jAA=='" {
+		t.Fatal("unexpected hash", s)
+	}
+}
+
+func TestAddHashBytes(t *testing.T) {
+	want := &cspbuilder.Directive{}
+	want.Hash(cspbuilder.SHA256, `doSomething()`)
+
+	digest := sha256.Sum256([]byte(`doSomething()`))
+
+	d := &cspbuilder.Directive{}
+	if err := d.AddHashBytes(cspbuilder.SHA256, digest[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	if d.String() != want.String() {
+		t.Fatal("want", want.String(), "got", d.String())
+	}
+
+	if err := d.AddHashBytes(cspbuilder.SHA512, digest[:]); err == nil {
+		t.Fatal("want error for wrong length digest")
+	}
+
+	if err := d.AddHashBytes(cspbuilder.HashType(1), digest[:]); err != cspbuilder.ErrInvalidHashType {
+		t.Fatal("want ErrInvalidHashType got", err)
+	}
+
+	if len(d.Sources()) != 1 {
+		t.Fatal("want 1 source got", d.Sources())
+	}
+}
+
+func TestEnableReportSample(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.New(cspbuilder.Style, cspbuilder.Self)
+	pol.New(cspbuilder.Img, cspbuilder.Self)
+
+	pol.EnableReportSample()
+	pol.EnableReportSample()
+	pol.Build()
+
+	for _, want := range []string{"script-src 'self' 'report-sample'", "style-src 'self' 'report-sample'", "img-src 'self'"} {
+		if !strings.Contains(pol.Compiled, want) {
+			t.Fatal("want", want, "got", pol.Compiled)
+		}
+	}
+
+	if n := strings.Count(pol.Compiled, cspbuilder.ReportSample); n != 2 {
+		t.Fatal("want 2 'report-sample' got", n, pol.Compiled)
+	}
+
+	pol.EnableReportSample(cspbuilder.Img, cspbuilder.Font)
+
+	if s := pol.Build(); !strings.Contains(s, "img-src 'self' 'report-sample'") || strings.Contains(s, cspbuilder.Font) {
+		t.Fatal("unexpected policy", s)
+	}
+}
+
+func TestDefaultFirst(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		pol := cspbuilder.Starter()
+		pol.New(cspbuilder.Font, cspbuilder.Self)
+
+		if s := pol.Build(); !strings.HasPrefix(s, "default-src 'none';") {
+			t.Fatal("want default-src first got", s)
+		}
+	}
+}
+
+func TestBuildWith(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.None)
+	pol.ReportURI = "/_csp-report"
+
+	if s := pol.BuildWith("; "); s != "default-src 'none'; report-uri /_csp-report" {
+		t.Fatal("want default-src 'none'; report-uri /_csp-report got", s)
+	}
+
+	if s := pol.BuildWith(";\n"); s != "default-src 'none';\nreport-uri /_csp-report" {
+		t.Fatal("want default-src 'none';\\nreport-uri /_csp-report got", s)
+	}
+
+	if s := pol.BuildWith(""); s != "default-src 'none';report-uri /_csp-report" {
+		t.Fatal("want default-src 'none';report-uri /_csp-report got", s)
+	}
+
+	if pol.Compiled != "" {
+		t.Fatal("BuildWith modified Compiled", pol.Compiled)
+	}
+}
+
+func TestNoncePool(t *testing.T) {
+	var (
+		a, b string
+		pol  = cspbuilder.New()
+	)
+
+	pol.New(cspbuilder.Script, cspbuilder.Nonce)
+	pol.RandReader = cspbuilder.NewNoncePool(40)
+
+	// drains and refills the pool
+	for i := 0; i < 5; i++ {
+		pol.WithNonce(&a)
+		s := pol.WithNonce(&b)
+
+		if len(a) != 22 || a == b || !strings.Contains(s, "'nonce-"+b+"'") {
+			t.Fatal("unexpected nonces", a, b, s)
+		}
+	}
+}
+
+func BenchmarkNoncePool(b *testing.B) {
+	pol := setup(1)
+	pol.RandReader = cspbuilder.NewNoncePool(0)
+	pol.Build()
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		var nonce string
+		pol.WithNonce(&nonce)
+	}
+}
+
+func TestHasGet(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.New(cspbuilder.FrameAncestors)
+
+	if !pol.Has(cspbuilder.Script) {
+		t.Fatal("want script-src")
+	}
+
+	if d, ok := pol.Get(cspbuilder.Script); !ok || !d.Contains(cspbuilder.Self) {
+		t.Fatal("want script-src 'self' got", d)
+	}
+
+	if d, ok := pol.Get(cspbuilder.FrameAncestors); !ok || len(d.Sources()) != 0 {
+		t.Fatal("want empty frame-ancestors got", d)
+	}
+
+	if pol.Has(cspbuilder.Img) {
+		t.Fatal("want no img-src")
+	}
+
+	if d, ok := pol.Get(cspbuilder.Img); ok || d != nil {
+		t.Fatal("want no img-src got", d)
+	}
+
+	if pol.Has(cspbuilder.Img) || len(pol.Directives()) != 2 {
+		t.Fatal("Get created directive")
+	}
+}
+
+func TestStrictDirectives(t *testing.T) {
+	cspbuilder.StrictDirectives = true
+	defer func() { cspbuilder.StrictDirectives = false }()
+
+	pol := cspbuilder.New()
+	pol.New("script-src", cspbuilder.Self)
+
+	for _, name := range []string{"scrpt-src", "report-uri", "Upgrade-Insecure-Requests", "block-all-mixed-content"} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatal("want panic for", name)
+				}
+			}()
+
+			pol.New(name, "/_csp-report")
+		}()
+	}
+
+	if s := pol.Build(); s != "script-src 'self'" {
+		t.Fatal("want script-src 'self' got", s)
+	}
+
+	// FromStruct still maps them to Policy fields
+	v := struct {
+		ReportURI string `csp:"report-uri"`
+		Upgrade   bool   `csp:"upgrade-insecure-requests"`
+	}{"/_csp-report", true}
+
+	if pol, err := cspbuilder.FromStruct(v); err != nil || pol.ReportURI != "/_csp-report" || !pol.UpgradeInsecureRequests {
+		t.Fatal("want report-uri and upgrade-insecure-requests fields got", pol, err)
+	}
+}
+
+func TestInlineSpeculationRules(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.InlineSpeculationRules)
+
+	if s := pol.Build(); s != "script-src 'self' 'inline-speculation-rules'" {
+		t.Fatal("want script-src 'self' 'inline-speculation-rules' got", s)
+	}
+
+	if l := pol.Level(); l != 3 {
+		t.Fatal("want level 3 got", l)
+	}
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.New(cspbuilder.Script, "cdn.example.com")
+
+	if s := pol.Build(); s != "script-src cdn.example.com" {
+		t.Fatal("New: want script-src cdn.example.com got", s)
+	}
+
+	pol = cspbuilder.New()
+	pol.Append(cspbuilder.Script, cspbuilder.Self)
+	pol.Append(cspbuilder.Script, "cdn.example.com")
+
+	if s := pol.Build(); s != "script-src 'self' cdn.example.com" {
+		t.Fatal("Append: want script-src 'self' cdn.example.com got", s)
+	}
+
+	pol.With(cspbuilder.Img, cspbuilder.SelfDirective)
+	pol.Append(cspbuilder.Img, "img.example.com")
+
+	if s := cspbuilder.SelfDirective.String(); s != cspbuilder.Self {
+		t.Fatal("SelfDirective modified", s)
+	}
+
+	if !strings.Contains(pol.Build(), "img-src 'self' img.example.com") {
+		t.Fatal("want img-src 'self' img.example.com got", pol.Compiled)
+	}
+}
+
+func TestValidateWildcard(t *testing.T) {
+	for _, name := range []string{cspbuilder.Script, cspbuilder.Object, cspbuilder.BaseURI, cspbuilder.Default} {
+		pol := cspbuilder.New()
+		pol.New(name, cspbuilder.All)
+
+		w := pol.Validate()
+		if len(w) != 1 || w[0].Directive != name || w[0].Level != cspbuilder.SeverityHigh {
+			t.Fatal("want high severity warning for", name, "got", w)
+		}
+	}
+
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Img, cspbuilder.All)
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+}
+
+func TestHardenDefaults(t *testing.T) {
+	if s := cspbuilder.Starter().Build(); !strings.Contains(s, "object-src 'none'") {
+		t.Fatal("want object-src 'none' got", s)
+	}
+
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.BaseURI, cspbuilder.None)
+	pol.HardenDefaults()
+
+	want := cspbuilder.New()
+	want.New(cspbuilder.BaseURI, cspbuilder.None)
+	want.New(cspbuilder.Object, cspbuilder.None)
+	want.New(cspbuilder.FrameAncestors, cspbuilder.None)
+
+	if !pol.Equal(want) {
+		t.Fatal("want", want.Build(), "got", pol.Build())
+	}
+
+	pol.HardenDefaults()
+
+	if !pol.Equal(want) {
+		t.Fatal("HardenDefaults not idempotent", pol.Build())
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	var buf bytes.Buffer
+
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.ReportURI = "/_csp-report"
+
+	n, err := pol.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pol.Compiled != "" {
+		t.Fatal("WriteTo modified Compiled", pol.Compiled)
+	}
+
+	if want := pol.Build(); buf.String() != want || n != int64(len(want)) {
+		t.Fatal("want", want, "got", n, buf.String())
+	}
+
+	pol = cspbuilder.Starter()
+	pol.Ordered = true
+	pol.Pretty = true
+	pol.TrailingSemicolon = true
+
+	buf.Reset()
+	n, _ = pol.WriteTo(&buf)
+
+	if want := pol.String(); buf.String() != want || n != int64(len(want)) {
+		t.Fatal("want", want, "got", n, buf.String())
+	}
+
+	pol.Build()
+
+	buf.Reset()
+	pol.WriteTo(&buf)
+
+	if buf.String() != pol.Compiled {
+		t.Fatal("want", pol.Compiled, "got", buf.String())
+	}
+
+	pol.Invalidate()
+	if _, err = pol.WriteTo(errWriter{}); err != io.ErrShortWrite {
+		t.Fatal("want", io.ErrShortWrite, "got", err)
+	}
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrShortWrite
+}
+
+func TestPolicyString(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.UpgradeInsecureRequests = true
+
+	s := fmt.Sprint(pol)
+	if pol.Compiled != "" {
+		t.Fatal("String() modified Compiled", pol.Compiled)
+	}
+
+	if want := pol.Build(); s != want {
+		t.Fatal("want", want, "got", s)
+	}
+
+	pol = cspbuilder.Starter()
+	pol.Build()
+
+	if s := fmt.Sprint(pol); s != pol.Compiled {
+		t.Fatal("want", pol.Compiled, "got", s)
+	}
+}
+
+func TestReportToHeader(t *testing.T) {
+	pol := cspbuilder.New()
+
+	if s := pol.ReportToHeader(); s != "" {
+		t.Fatal("want empty Report-To got", s)
+	}
+
+	pol.SetReportTo("csp-endpoint", "https://example.com/a", 86400)
+	pol.SetReportTo("csp-endpoint", "https://example.com/b", 86400)
+
+	want := `{"group":"csp-endpoint","max_age":86400,"endpoints":[{"url":"https://example.com/a"},{"url":"https://example.com/b"}]}`
+	if s := pol.ReportToHeader(); s != want {
+		t.Fatal("want", want, "got", s)
+	}
+
+	if s := pol.Build(); s != "report-to csp-endpoint" {
+		t.Fatal("want report-to csp-endpoint got", s)
+	}
+}
+
+func TestMapExcluding(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.SetReporting("/_csp-report", "csp-endpoint")
+
+	m := pol.MapExcluding(cspbuilder.ReportTo)
+
+	if _, ok := m[cspbuilder.ReportTo]; ok {
+		t.Fatal("want no report-to got", m)
+	}
+
+	if len(m) != 2 || m[cspbuilder.Script] != cspbuilder.Self || m["report-uri"] != "/_csp-report" {
+		t.Fatal("unexpected map", m)
+	}
+
+	if m := pol.Map(); m[cspbuilder.ReportTo] != "csp-endpoint" {
+		t.Fatal("want report-to csp-endpoint got", m)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	want := "cdn.example.com https: 'self' 'unsafe-inline' $NONCE 'sha256-abc='"
+
+	for _, sources := range [][]string{
+		{cspbuilder.Nonce, cspbuilder.UnsafeInline, "'sha256-abc='", "https:", cspbuilder.Self, "cdn.example.com"},
+		{"'sha256-abc='", "https:", "cdn.example.com", cspbuilder.Self, cspbuilder.Nonce, cspbuilder.UnsafeInline},
+	} {
+		d := &cspbuilder.Directive{}
+		d.Add(sources...)
+		d.Normalize()
+
+		if d.String() != want {
+			t.Fatal("want", want, "got", d.String())
+		}
+	}
+}
+
+func TestBuildOnly(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.None)
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.New(cspbuilder.Style, cspbuilder.Self)
+	pol.New(cspbuilder.Img, cspbuilder.All)
+	pol.New(cspbuilder.Font, cspbuilder.Self)
+	pol.ReportURI = "/_csp-report"
+
+	s := pol.BuildOnly(cspbuilder.Script, cspbuilder.Style)
+
+	for _, want := range []string{"script-src 'self'", "style-src 'self'", "report-uri /_csp-report"} {
+		if !strings.Contains(s, want) {
+			t.Fatal("want", want, "got", s)
+		}
+	}
+
+	for _, name := range []string{cspbuilder.Default, cspbuilder.Img, cspbuilder.Font} {
+		if strings.Contains(s, name) {
+			t.Fatal("want no", name, "got", s)
+		}
+	}
+
+	if pol.Compiled != "" {
+		t.Fatal("BuildOnly modified Compiled", pol.Compiled)
+	}
+}
+
+func TestStats(t *testing.T) {
+	pol := cspbuilder.Starter()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce).HashAll(cspbuilder.SHA256, `a()`, `b()`)
+	pol.New(cspbuilder.Style, cspbuilder.Self, cspbuilder.Nonce, cspbuilder.UnsafeInline)
+	pol.New(cspbuilder.Img, cspbuilder.All, "*.example.com")
+
+	want := cspbuilder.PolicyStats{
+		DirectiveCount:   8,
+		NonceDirectives:  2,
+		HashSources:      2,
+		WildcardSources:  2,
+		UsesUnsafeInline: true,
+	}
+
+	if st := pol.Stats(); st != want {
+		t.Fatalf("want %+v got %+v", want, st)
+	}
+
+	if st := cspbuilder.New().Stats(); st != (cspbuilder.PolicyStats{}) {
+		t.Fatalf("want zero stats got %+v", st)
+	}
+}
+
+func TestStarterWith(t *testing.T) {
+	for i := 0; i < 8; i++ {
+		opts := cspbuilder.StarterOptions{
+			UpgradeInsecure: i&1 != 0,
+			ScriptNonce:     i&2 != 0,
+		}
+		if i&4 != 0 {
+			opts.ReportURI = "/_csp-report"
+		}
+
+		pol := cspbuilder.StarterWith(opts)
+		s := pol.Build()
+
+		if !strings.HasPrefix(s, "default-src 'none'") {
+			t.Fatal("want Starter() defaults got", s)
+		}
+
+		if strings.Contains(s, "upgrade-insecure-requests") != opts.UpgradeInsecure {
+			t.Fatal("upgrade-insecure-requests mismatch", opts, s)
+		}
+
+		if strings.Contains(s, "script-src 'self' $NONCE") != opts.ScriptNonce || pol.RequireNonce != opts.ScriptNonce {
+			t.Fatal("script nonce mismatch", opts, s)
+		}
+
+		if strings.Contains(s, "report-uri /_csp-report") != (opts.ReportURI != "") {
+			t.Fatal("report-uri mismatch", opts, s)
+		}
+	}
+}
+
+func TestAddEventHandlerHash(t *testing.T) {
+	want := &cspbuilder.Directive{}
+	want.Hash(cspbuilder.SHA256, `alert(1)`)
+
+	d := &cspbuilder.Directive{}
+	d.AddEventHandlerHash(cspbuilder.SHA256, `alert(1)`)
+	d.AddEventHandlerHash(cspbuilder.SHA256, `alert(2)`)
+
+	s := d.String()
+	if strings.Count(s, cspbuilder.UnsafeHashes) != 1 {
+		t.Fatal("want 'unsafe-hashes' once got", s)
+	}
+
+	if !d.Contains(want.String()) || len(d.Sources()) != 3 {
+		t.Fatal("want", want.String(), "got", s)
+	}
+}
+
+func TestBlockAllMixedContent(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.Self)
+	pol.BlockAllMixedContent = true
+
+	if s := pol.Build(); s != "default-src 'self';block-all-mixed-content" {
+		t.Fatal("want default-src 'self';block-all-mixed-content got", s)
+	}
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+
+	pol.UpgradeInsecureRequests = true
+
+	if s := pol.Build(); s != "default-src 'self';upgrade-insecure-requests;block-all-mixed-content" {
+		t.Fatal("want default-src 'self';upgrade-insecure-requests;block-all-mixed-content got", s)
+	}
+
+	if w := pol.Validate(); len(w) != 1 || w[0].Directive != "block-all-mixed-content" {
+		t.Fatal("want redundant warning got", w)
+	}
+}
+
+func TestDirectiveNameCase(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.Append("Script-Src", cspbuilder.Self)
+	pol.Append("script-src", "CDN.example.com")
+
+	if s := pol.Build(); s != "script-src 'self' CDN.example.com" {
+		t.Fatal("want script-src 'self' CDN.example.com got", s)
+	}
+
+	if !pol.Has("SCRIPT-SRC") {
+		t.Fatal("want SCRIPT-SRC")
+	}
+
+	pol.Remove("Script-SRC")
+
+	if len(pol.Directives()) != 0 {
+		t.Fatal("want no directives got", pol.Directives())
+	}
+}
+
+func TestCompact(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, "https://example.com", "https://cdn.example.com")
+	pol.New(cspbuilder.Connect, "https://example.com")
+
+	if n := pol.Compact("https://example.com"); n != 1 {
+		t.Fatal("want 1 removed got", n)
+	}
+
+	if s := pol.BuildOnly(cspbuilder.Script); s != "script-src 'self' https://cdn.example.com" {
+		t.Fatal("want script-src 'self' https://cdn.example.com got", s)
+	}
+
+	if s := pol.BuildOnly(cspbuilder.Connect); s != "connect-src https://example.com" {
+		t.Fatal("want connect-src https://example.com got", s)
+	}
+}
+
+func TestExpandChildSrc(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Child, cspbuilder.Self, "https://embed.example.com")
+	pol.New(cspbuilder.Frame, "https://frames.example.com")
+
+	pol.ExpandChildSrc()
+
+	if s := pol.BuildOnly(cspbuilder.Frame); s != "frame-src https://frames.example.com" {
+		t.Fatal("want frame-src https://frames.example.com got", s)
+	}
+
+	if s := pol.BuildOnly(cspbuilder.Worker); s != "worker-src 'self' https://embed.example.com" {
+		t.Fatal("want worker-src 'self' https://embed.example.com got", s)
+	}
+
+	if d, _ := pol.Get(cspbuilder.Child); d.Contains("https://frames.example.com") {
+		t.Fatal("child-src modified", d)
+	}
+}
+
+func TestDirectiveNote(t *testing.T) {
+	pol := cspbuilder.New()
+	d := pol.New(cspbuilder.Script, cspbuilder.Self, "https://cdn.example.com", cspbuilder.Nonce)
+	d.Note = "cdn.example.com serves the analytics bundle"
+
+	if s := pol.Build(); strings.Contains(s, "analytics") {
+		t.Fatal("note in policy", s)
+	}
+
+	b, err := json.Marshal(pol.Directives())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dirs map[string]*cspbuilder.Directive
+	if err := json.Unmarshal(b, &dirs); err != nil {
+		t.Fatal(err)
+	}
+
+	got := dirs[cspbuilder.Script]
+	if got == nil || got.Note != d.Note || got.String() != d.String() {
+		t.Fatal("want", d.Note, d.String(), "got", string(b))
+	}
+
+	pol2 := cspbuilder.New().With(cspbuilder.Script, got)
+	if s := pol2.Build(); strings.Contains(s, "analytics") || !pol2.RequireNonce {
+		t.Fatal("want nonce policy without note got", s)
+	}
+}
+
+func TestUnmarshalImmutableDirective(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.BaseURI, cspbuilder.Self)
+	pol.LockDirective(cspbuilder.BaseURI)
+
+	d, _ := pol.Get(cspbuilder.BaseURI)
+
+	for _, d := range []*cspbuilder.Directive{d, cspbuilder.SelfDirective} {
+		if err := json.Unmarshal([]byte(`{"sources":["*"]}`), d); !errors.Is(err, cspbuilder.ErrImmutableDirective) {
+			t.Fatal("want", cspbuilder.ErrImmutableDirective, "got", err)
+		}
+
+		if d.Contains(cspbuilder.All) {
+			t.Fatal("want directive unchanged got", d)
+		}
+	}
+}
+
+func TestMatchesHash(t *testing.T) {
+	d := &cspbuilder.Directive{}
+	d.Add(cspbuilder.Self)
+	d.Hash(cspbuilder.SHA256, "doSomething()")
+
+	if !d.MatchesHash(cspbuilder.SHA256, "doSomething()") {
+		t.Fatal("want match")
+	}
+
+	if d.MatchesHash(cspbuilder.SHA256, "doSomethingElse()") {
+		t.Fatal("want no match for other script")
+	}
+
+	if d.MatchesHash(cspbuilder.SHA384, "doSomething()") {
+		t.Fatal("want no match for other hash type")
+	}
+
+	if d.MatchesHash(cspbuilder.HashType(1), "doSomething()") {
+		t.Fatal("want no match for invalid hash type")
+	}
+}
+
+func TestTrailingSemicolon(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.None)
+	pol.UpgradeInsecureRequests = true
+
+	if s := pol.Build(); s != "default-src 'none';upgrade-insecure-requests" {
+		t.Fatal("want default-src 'none';upgrade-insecure-requests got", s)
+	}
+
+	pol.TrailingSemicolon = true
+
+	if s := pol.Build(); s != "default-src 'none';upgrade-insecure-requests;" {
+		t.Fatal("want default-src 'none';upgrade-insecure-requests; got", s)
+	}
+
+	empty := cspbuilder.New()
+	empty.TrailingSemicolon = true
+
+	if s := empty.Build(); s != "" {
+		t.Fatal("want empty policy got", s)
+	}
+}
+
+func TestValidateNavigateTo(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.NavigateTo, cspbuilder.Self, "https://login.example.com")
+
+	if s := pol.Build(); s != "navigate-to 'self' https://login.example.com" {
+		t.Fatal("want navigate-to 'self' https://login.example.com got", s)
+	}
+
+	w := pol.Validate()
+	if len(w) != 1 || w[0].Directive != cspbuilder.NavigateTo || !strings.Contains(w[0].Message, "deprecated") {
+		t.Fatal("want navigate-to deprecation got", w)
+	}
+}
+
+func TestMinify(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.Self, "https://example.com")
+	pol.New(cspbuilder.Img, cspbuilder.Self)
+	pol.New(cspbuilder.Font, cspbuilder.Self, "https://example.com")
+	pol.New(cspbuilder.Script, cspbuilder.Self, "https://cdn.example.com")
+	pol.New(cspbuilder.ScriptElem, cspbuilder.Self)
+	pol.New(cspbuilder.BaseURI, cspbuilder.Self)
+	pol.New(cspbuilder.Form, cspbuilder.Self, "https://example.com")
+
+	min := pol.Minify("https://example.com")
+
+	for _, name := range []string{cspbuilder.Img, cspbuilder.Font} {
+		if min.Has(name) {
+			t.Fatal("want", name, "dropped got", min.Build())
+		}
+	}
+
+	// script-src-elem falls back to script-src, which differs
+	for _, name := range []string{cspbuilder.Default, cspbuilder.Script, cspbuilder.ScriptElem, cspbuilder.BaseURI, cspbuilder.Form} {
+		if !min.Has(name) {
+			t.Fatal("want", name, "kept got", min.Build())
+		}
+	}
+
+	if !pol.Has(cspbuilder.Img) || !pol.Has(cspbuilder.Font) {
+		t.Fatal("original policy modified")
+	}
+}
+
+func TestSlice(t *testing.T) {
+	sources := []string{cspbuilder.Self, "https://cdn.example.com", cspbuilder.Nonce}
+
+	pol := cspbuilder.New()
+	d := pol.NewFromSlice(cspbuilder.Script, sources)
+	sources[1] = "https://evil.example.com"
+
+	if s := pol.Build(); s != "script-src 'self' https://cdn.example.com $NONCE" || !pol.RequireNonce {
+		t.Fatal("want script-src 'self' https://cdn.example.com $NONCE got", s)
+	}
+
+	d.AddSlice([]string{"https://img.example.com", cspbuilder.Data})
+
+	if s := d.String(); s != "'self' https://cdn.example.com $NONCE https://img.example.com data:" {
+		t.Fatal("want 'self' https://cdn.example.com $NONCE https://img.example.com data: got", s)
+	}
+}
+
+func TestFromStruct(t *testing.T) {
+	type config struct {
+		Addr    string   `env:"ADDR"`
+		Default []string `csp:"default-src"`
+		Script  []string `csp:"script-src"`
+		Img     []string `csp:"img-src"`
+		Upgrade bool     `csp:"upgrade-insecure-requests"`
+		Report  string   `csp:"report-uri"`
+	}
+
+	pol, err := cspbuilder.FromStruct(&config{
+		Addr:    ":8080",
+		Default: []string{cspbuilder.Self},
+		Script:  []string{cspbuilder.Self, "https://cdn.example.com"},
+		Upgrade: true,
+		Report:  "/_csp-report",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pol.Has(cspbuilder.Img) {
+		t.Fatal("want empty img-src skipped")
+	}
+
+	if s := pol.BuildOnly(cspbuilder.Script); s != "script-src 'self' https://cdn.example.com;upgrade-insecure-requests;report-uri /_csp-report" {
+		t.Fatal("want script-src 'self' https://cdn.example.com;upgrade-insecure-requests;report-uri /_csp-report got", s)
+	}
+
+	if !pol.Has(cspbuilder.Default) {
+		t.Fatal("want default-src")
+	}
+
+	type badName struct {
+		Script []string `csp:"scirpt-src"`
+	}
+
+	type badType struct {
+		Script string `csp:"script-src"`
+	}
+
+	for _, v := range []interface{}{badName{}, badType{}, "script-src", (*config)(nil)} {
+		if _, err := cspbuilder.FromStruct(v); err == nil {
+			t.Fatal("want error for", v)
+		}
+	}
+}
+
+func TestWithFixedNonce(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	if s := pol.WithFixedNonce("test-nonce"); s != "script-src 'self' 'nonce-test-nonce'" {
+		t.Fatal("want script-src 'self' 'nonce-test-nonce' got", s)
+	}
+
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.Build()
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("want panic without nonce placeholder")
+		}
+	}()
+
+	pol.WithFixedNonce("test-nonce")
+}
+
+func TestHashType(t *testing.T) {
+	for ht, want := range map[cspbuilder.HashType]string{
+		cspbuilder.SHA256:        "sha256",
+		cspbuilder.SHA384:        "sha384",
+		cspbuilder.SHA512:        "sha512",
+		cspbuilder.HashType(160): "",
+	} {
+		if ht.Valid() != (want != "") {
+			t.Fatal("want valid", want != "", "got", ht.Valid(), "for", ht)
+		}
+
+		if p := ht.Prefix(); p != want {
+			t.Fatal("want", want, "got", p)
+		}
+	}
+}
+
+func TestDirectiveRequireNonce(t *testing.T) {
+	pol := cspbuilder.New()
+	d := pol.New(cspbuilder.Script, cspbuilder.Self)
+
+	d.RequireNonce()
+	d.RequireNonce()
+
+	if s := pol.Build(); s != "script-src 'self' $NONCE" || !pol.RequireNonce {
+		t.Fatal("want script-src 'self' $NONCE got", s)
+	}
+}
+
+func TestFencedFrame(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.FencedFrame, cspbuilder.HTTPS)
+
+	if s := pol.Build(); s != "fenced-frame-src https:" {
+		t.Fatal("want fenced-frame-src https: got", s)
+	}
+
+	if l := pol.Level(); l != 3 {
+		t.Fatal("want level 3 got", l)
+	}
+}
+
+func TestApplyPresets(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+
+	pol.Apply(cspbuilder.PresetRecaptcha, cspbuilder.PresetStripe, cspbuilder.Presets["google-recaptcha"])
+
+	if s := pol.BuildOnly(cspbuilder.Script); s != "script-src 'self' https://www.google.com/recaptcha/ https://www.gstatic.com/recaptcha/ https://js.stripe.com https://*.js.stripe.com" {
+		t.Fatal("want combined script-src got", s)
+	}
+
+	if s := pol.BuildOnly(cspbuilder.Connect); s != "connect-src https://www.google.com/recaptcha/ https://api.stripe.com" {
+		t.Fatal("want combined connect-src got", s)
+	}
+
+	if d, _ := pol.Get(cspbuilder.Frame); len(d.Sources()) != 5 {
+		t.Fatal("want 5 frame-src sources got", d)
+	}
+}
+
+func TestLockDirective(t *testing.T) {
+	pol := cspbuilder.Starter()
+	pol.LockDirective(cspbuilder.BaseURI)
+
+	mustPanic := func(name string, fn func()) {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Fatal("want panic for", name)
+			}
+		}()
+		fn()
+	}
+
+	mustPanic("New", func() { pol.New(cspbuilder.BaseURI, cspbuilder.All) })
+	mustPanic("With", func() { pol.With("Base-URI", cspbuilder.NoneDirective) })
+	mustPanic("Remove", func() { pol.Remove(cspbuilder.BaseURI) })
+	mustPanic("Append", func() { pol.Append(cspbuilder.BaseURI, cspbuilder.All) })
+
+	d, _ := pol.Get(cspbuilder.BaseURI)
+	mustPanic("Add", func() { d.Add(cspbuilder.All) })
+
+	if n := pol.RemoveSourceEverywhere(cspbuilder.Self); n == 0 || !d.Contains(cspbuilder.Self) {
+		t.Fatal("want base-uri 'self' kept got", d)
+	}
+
+	if s := pol.BuildOnly(cspbuilder.BaseURI); s != "base-uri 'self'" {
+		t.Fatal("want base-uri 'self' got", s)
+	}
+	// locking absent directives prevents adding them
+	pol = cspbuilder.New()
+	pol.New(cspbuilder.Child, cspbuilder.Self)
+	pol.LockDirective(cspbuilder.Style)
+	pol.LockDirective(cspbuilder.Worker)
+	pol.LockDirective(cspbuilder.FrameAncestors)
+
+	mustPanic("RequireNonceOn", func() { pol.RequireNonceOn(cspbuilder.Style) })
+	mustPanic("ExpandChildSrc", func() { pol.ExpandChildSrc() })
+	mustPanic("HardenDefaults", func() { pol.HardenDefaults() })
+
+	if pol.Has(cspbuilder.Style) || pol.Has(cspbuilder.Worker) || pol.Has(cspbuilder.FrameAncestors) {
+		t.Fatal("want locked directives absent got", pol.Build())
+	}
+}
+
+func TestLockDirectiveMerge(t *testing.T) {
+	a := cspbuilder.New()
+	a.New(cspbuilder.Default, cspbuilder.Self)
+	a.New(cspbuilder.BaseURI, cspbuilder.Self)
+	a.LockDirective(cspbuilder.BaseURI)
+
+	b := cspbuilder.New()
+	b.New(cspbuilder.BaseURI, cspbuilder.All)
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("want panic merging into locked base-uri")
+		}
+	}()
+
+	a.Merge(b)
+}
+
+func TestLockDirectiveMergeBuild(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.BaseURI, cspbuilder.Self)
+	pol.LockDirective(cspbuilder.BaseURI)
+
+	d := &cspbuilder.Directive{}
+	d.Add(cspbuilder.All)
+
+	if s := pol.MergeBuild(map[string]*cspbuilder.Directive{cspbuilder.BaseURI: d}); s != "base-uri 'self'" {
+		t.Fatal("want base-uri 'self' got", s)
+	}
+
+	pol.New(cspbuilder.Default, cspbuilder.Self)
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+
+	for _, p := range []*cspbuilder.Policy{pol.Merge(cspbuilder.New()), pol.Minify("")} {
+		d, _ := p.Get(cspbuilder.BaseURI)
+		if !d.Contains(cspbuilder.Self) {
+			t.Fatal("want base-uri 'self' got", p.Build())
+		}
+
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Fatal("want locked base-uri in", p.Build())
+				}
+			}()
+			p.New(cspbuilder.BaseURI, cspbuilder.All)
+		}()
+	}
+}
+
+func TestSetHeader(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	var nonce string
+	h := http.Header{}
+	pol.SetHeader(h, false, &nonce)
+
+	if s := h.Get("Content-Security-Policy"); nonce == "" || s != "script-src 'self' 'nonce-"+nonce+"'" {
+		t.Fatal("want script-src 'self' 'nonce-"+nonce+"' got", s)
+	}
+
+	h = http.Header{}
+	pol.SetHeader(h, true, &nonce)
+
+	if s := h.Get("Content-Security-Policy-Report-Only"); s != "script-src 'self' 'nonce-"+nonce+"'" {
+		t.Fatal("want same nonce in report-only header got", s)
+	}
+
+	if s := h.Get("Content-Security-Policy"); s != "" {
+		t.Fatal("want no enforcing header got", s)
+	}
+
+	h = http.Header{}
+	pol.SetHeader(h, false, nil)
+
+	if s := h.Get("Content-Security-Policy"); !strings.HasPrefix(s, "script-src 'self' 'nonce-") || strings.Contains(s, nonce) {
+		t.Fatal("want new nonce got", s)
+	}
+}
+
+func TestNonceEncoding(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Nonce)
+
+	for _, tt := range []struct {
+		enc  *base64.Encoding
+		want string
+	}{
+		{nil, "_____________________w"},
+		{base64.RawURLEncoding, "_____________________w"},
+		{base64.StdEncoding, "/////////////////////w=="},
+	} {
+		var nonce string
+
+		pol.NonceEncoding = tt.enc
+		pol.RandReader = bytes.NewReader(bytes.Repeat([]byte{0xff}, 16))
+
+		if s := pol.WithNonce(&nonce); nonce != tt.want || s != "script-src 'nonce-"+tt.want+"'" {
+			t.Fatal("want", tt.want, "got", nonce, s)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	pol := cspbuilder.New()
+	d := pol.New(cspbuilder.Img, cspbuilder.Self)
+
+	if n := pol.Size(); n != len("img-src 'self'") {
+		t.Fatal("want", len("img-src 'self'"), "got", n)
+	}
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+
+	for i := 0; i < 200; i++ {
+		d.Add(fmt.Sprintf("https://img%d.example.com", i))
+	}
+	pol.Build()
+
+	if n := pol.Size(); n <= cspbuilder.MaxPolicySize {
+		t.Fatal("want over", cspbuilder.MaxPolicySize, "got", n)
+	}
+
+	if w := pol.Validate(); len(w) != 1 || w[0].Directive != "" || w[0].Level != cspbuilder.SeverityWarning {
+		t.Fatal("want size warning got", w)
+	}
+}
+
+func TestMergeBuildNone(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.None)
+
+	if s := pol.MergeBuild(map[string]*cspbuilder.Directive{cspbuilder.Default: {}}); s != "default-src 'none'" {
+		t.Fatal("want default-src 'none' got", s)
+	}
+
+	d := &cspbuilder.Directive{}
+	d.Add("https://cdn.example.com")
+
+	if s := pol.MergeBuild(map[string]*cspbuilder.Directive{cspbuilder.Default: d}); s != "default-src https://cdn.example.com" {
+		t.Fatal("want default-src https://cdn.example.com got", s)
+	}
+
+	pol.New(cspbuilder.Default, cspbuilder.Self)
+
+	if s := pol.MergeBuild(map[string]*cspbuilder.Directive{cspbuilder.Default: d}); s != "default-src 'self' https://cdn.example.com" {
+		t.Fatal("want default-src 'self' https://cdn.example.com got", s)
+	}
+}
+
+func TestBuildNonce(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	s, nonce := pol.BuildNonce()
+	if nonce == "" || s != "script-src 'self' 'nonce-"+nonce+"'" {
+		t.Fatal("want script-src 'self' 'nonce-"+nonce+"' got", s)
+	}
+
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.Build()
+
+	if s, nonce = pol.BuildNonce(); nonce != "" || s != "script-src 'self'" {
+		t.Fatal("want script-src 'self' without nonce got", s, nonce)
+	}
+}
+
+func TestAddNone(t *testing.T) {
+	d := &cspbuilder.Directive{}
+	d.Add("cdn.example.com", cspbuilder.Nonce)
+	d.Add(cspbuilder.None)
+
+	if s := d.String(); s != "'none'" {
+		t.Fatal("want 'none' got", s)
+	}
+
+	d.Add(cspbuilder.Self)
+
+	if s := d.String(); s != "'self'" {
+		t.Fatal("want 'self' got", s)
+	}
+
+	pol := cspbuilder.New().With(cspbuilder.Script, d)
+	if pol.Build(); pol.RequireNonce {
+		t.Fatal("want nonce cleared by 'none'")
+	}
+}
+
+func TestCompressedSize(t *testing.T) {
+	const cdn = "https://static-assets.cdn.example-content-delivery.com"
+
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.Self, cdn)
+	for _, name := range []string{cspbuilder.Script, cspbuilder.Style, cspbuilder.Img, cspbuilder.Font, cspbuilder.Media, cspbuilder.Connect} {
+		pol.New(name, cspbuilder.Self, cdn)
+	}
+
+	min := pol.Minify("")
+	if min.Size() >= pol.Size() {
+		t.Fatal("want minified policy smaller got", min.Size(), pol.Size())
+	}
+
+	if n := pol.CompressedSize(); n <= 0 || n >= pol.Size() {
+		t.Fatal("want compressed size under", pol.Size(), "got", n)
+	}
+
+	if a, b := min.CompressedSize(), pol.CompressedSize(); a >= b {
+		t.Fatal("want minified compressed size under", b, "got", a)
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	pol := cspbuilder.Starter()
+	pol.New(cspbuilder.Script, cspbuilder.Self, "https://cdn.example.com")
+	pol.UpgradeInsecureRequests = true
+	pol.ReportURI = "/_csp-report"
+	pol.ReportURIs = []string{"https://report.example.com/csp"}
+
+	m := map[string][]string{}
+	for k, v := range pol.Map() {
+		m[k] = strings.Fields(v)
+	}
+
+	if got := cspbuilder.FromMap(m); !got.Equal(pol) {
+		t.Fatal("want", pol.Build(), "got", got.Build())
+	}
+
+	got := cspbuilder.FromMap(map[string][]string{cspbuilder.Script: {cspbuilder.Self, cspbuilder.Nonce}})
+	if s := got.Build(); s != "script-src 'self' $NONCE" || !got.RequireNonce {
+		t.Fatal("want script-src 'self' $NONCE got", s)
+	}
+}
+
+func TestStripReportSample(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.ReportSample)
+
+	if s := pol.Build(); s != "script-src 'self' 'report-sample'" {
+		t.Fatal("want script-src 'self' 'report-sample' got", s)
+	}
+
+	pol.StripReportSample = true
+
+	if s := pol.Build(); s != "script-src 'self'" {
+		t.Fatal("want script-src 'self' got", s)
+	}
+
+	pol.ReportURI = "/_csp-report"
+
+	if s := pol.Build(); s != "script-src 'self' 'report-sample';report-uri /_csp-report" {
+		t.Fatal("want script-src 'self' 'report-sample';report-uri /_csp-report got", s)
+	}
+}
+
+func TestValidateRequireTrustedTypesFor(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.RequireTrustedTypesFor, cspbuilder.TrustedScript)
+
+	if w := pol.Validate(); len(w) != 0 {
+		t.Fatal("want no warnings got", w)
+	}
+
+	pol.Append(cspbuilder.RequireTrustedTypesFor, "cdn.com", "'style'")
+
+	w := pol.Validate()
+	if len(w) != 2 || !strings.HasPrefix(w[0].Message, "cdn.com") || !strings.HasPrefix(w[1].Message, "'style'") {
+		t.Fatal("want 2 warnings got", w)
+	}
+}
+
+func TestAppendTo(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+
+	b := pol.AppendTo([]byte("csp="))
+	if string(b) != "csp=script-src 'self'" {
+		t.Fatal("want csp=script-src 'self' got", string(b))
+	}
+
+	buf := make([]byte, 0, 64)
+	if n := testing.AllocsPerRun(100, func() { buf = pol.AppendTo(buf[:0]) }); n != 0 {
+		t.Fatal("want 0 allocs got", n)
+	}
+}
+
+func BenchmarkAppendTo(b *testing.B) {
+	pol := setup(1)
+	pol.Build()
+	buf := make([]byte, 0, 4096)
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		buf = pol.AppendTo(buf[:0])
+	}
+}
+
+func TestCheckCoverage(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.Self)
+	pol.New(cspbuilder.Script, cspbuilder.Self, "https://cdn.example.com")
+	pol.New(cspbuilder.Img, cspbuilder.Self, cspbuilder.Data)
+
+	missing := pol.CheckCoverage(cspbuilder.Script, cspbuilder.ScriptElem, cspbuilder.Connect, cspbuilder.Img, cspbuilder.Font)
+	if fmt.Sprint(missing) != "[connect-src font-src]" {
+		t.Fatal("want [connect-src font-src] got", missing)
+	}
+
+	all := fmt.Sprint(pol.CheckCoverage())
+	for _, name := range []string{cspbuilder.Connect, cspbuilder.Font, cspbuilder.Frame} {
+		if !strings.Contains(all, name) {
+			t.Fatal("want", name, "got", all)
+		}
+	}
+
+	// worker-src and script-src-elem fall back to script-src
+	for _, name := range []string{cspbuilder.Script, cspbuilder.ScriptElem, cspbuilder.Worker, cspbuilder.Img} {
+		if strings.Contains(all, name+" ") || strings.HasSuffix(all, name+"]") {
+			t.Fatal("want", name, "covered got", all)
+		}
+	}
+}
+
+func TestOrdered(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.New(cspbuilder.Img, cspbuilder.Data)
+	pol.New(cspbuilder.Default, cspbuilder.None)
+	pol.New(cspbuilder.Style, cspbuilder.Self)
+	pol.Remove(cspbuilder.Img)
+	pol.Append(cspbuilder.Img, cspbuilder.Self)
+	pol.New(cspbuilder.Script, cspbuilder.Self, "https://cdn.example.com")
+	pol.Ordered = true
+
+	want := "script-src 'self' https://cdn.example.com;default-src 'none';style-src 'self';img-src 'self'"
+	if s := pol.Build(); s != want {
+		t.Fatal("want", want, "got", s)
+	}
+
+	if s := pol.Merge(cspbuilder.New()).Build(); s != want {
+		t.Fatal("want", want, "got", s)
+	}
+}
+
+func TestNoncePlaceholderCount(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+
+	if n := pol.NoncePlaceholderCount(); n != 0 {
+		t.Fatal("want 0 got", n)
+	}
+
+	pol.RequireNonceOn(cspbuilder.Script, cspbuilder.Style)
+	pol.Build()
+
+	if n := pol.NoncePlaceholderCount(); n != 2 {
+		t.Fatal("want 2 got", n)
+	}
+}
+
+func TestAddOrigin(t *testing.T) {
+	d := &cspbuilder.Directive{}
+
+	for _, rawurl := range []string{
+		"https://cdn.example.com/lib.js?v=1#x",
+		"www.google.com/recaptcha/",
+		"HTTP://Assets.Example.com:8080/img/",
+	} {
+		if err := d.AddOrigin(rawurl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s := d.String(); s != "https://cdn.example.com https://www.google.com http://assets.example.com:8080" {
+		t.Fatal("want https://cdn.example.com https://www.google.com http://assets.example.com:8080 got", s)
+	}
+
+	for _, rawurl := range []string{"https://", "https:///lib.js", "https://cdn example.com"} {
+		if err := d.AddOrigin(rawurl); err == nil {
+			t.Fatal("want error for", rawurl)
+		}
+	}
+}
+
+func TestStrictCSP(t *testing.T) {
+	pol := cspbuilder.StrictCSP()
+
+	if !pol.RequireNonce {
+		t.Fatal("want RequireNonce")
+	}
+
+	want := "script-src $NONCE 'strict-dynamic' https: 'unsafe-inline';object-src 'none';base-uri 'none'"
+	if s := pol.Build(); s != want || !pol.RequireNonce {
+		t.Fatal("want", want, "got", s)
+	}
+}
+
+func TestReportingEndpointsHeader(t *testing.T) {
+	pol := cspbuilder.New()
+
+	if s := pol.ReportingEndpointsHeader(); s != "" {
+		t.Fatal("want empty Reporting-Endpoints got", s)
+	}
+
+	pol.SetReportTo("csp-endpoint", "https://example.com/a", 86400)
+	pol.SetReportTo("csp-endpoint", "https://example.com/b", 86400)
+	pol.SetReportTo("default", "https://example.com/reports", 86400)
+
+	want := `csp-endpoint="https://example.com/a", default="https://example.com/reports"`
+	if s := pol.ReportingEndpointsHeader(); s != want {
+		t.Fatal("want", want, "got", s)
+	}
+}
+
+func TestRequireNonceWithoutPlaceholder(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Script, cspbuilder.Self)
+	pol.Build()
+	pol.RequireNonce = true
+
+	nonce := "unchanged"
+	if s, n := pol.WithNonceCount(&nonce); s != "script-src 'self'" || n != 0 || nonce != "unchanged" {
+		t.Fatal("want script-src 'self' 0 unchanged got", s, n, nonce)
+	}
+}
+
+func TestMinifyKeepsFallbackChain(t *testing.T) {
+	pol := cspbuilder.New()
+	pol.New(cspbuilder.Default, cspbuilder.Self)
+	pol.New(cspbuilder.Child, cspbuilder.Self)
+	pol.New(cspbuilder.Script, "cdn.com")
+
+	min := pol.Minify("")
+
+	// worker-src falls back to child-src before script-src
+	if !min.Has(cspbuilder.Child) {
+		t.Fatal("want child-src kept got", min.Build())
+	}
+
+	pol.New(cspbuilder.Worker, cspbuilder.Self)
+	pol.New(cspbuilder.Frame, cspbuilder.Self)
+	pol.New(cspbuilder.FencedFrame, cspbuilder.Self)
+
+	// worker-src would fall back to script-src without child-src
+	min = pol.Minify("")
+	if min.Has(cspbuilder.Child) || min.Has(cspbuilder.Frame) || min.Has(cspbuilder.FencedFrame) || !min.Has(cspbuilder.Worker) {
+		t.Fatal("want worker-src kept got", min.Build())
+	}
+}
+
+func TestMergeNone(t *testing.T) {
+	other := cspbuilder.New()
+	other.New(cspbuilder.Default, cspbuilder.Self)
+	other.New(cspbuilder.Script, cspbuilder.None)
+
+	pol := cspbuilder.Starter().Merge(other)
+
+	if s := pol.BuildOnly(cspbuilder.Default); s != "default-src 'self'" {
+		t.Fatal("want default-src 'self' got", s)
+	}
+
+	if s := pol.BuildOnly(cspbuilder.Script); s != "script-src 'self'" {
+		t.Fatal("want script-src 'self' got", s)
+	}
+}
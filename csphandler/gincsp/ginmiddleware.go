@@ -3,18 +3,32 @@ package gincsp
 
 import (
 	"html/template"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jaynzr/cspbuilder"
 )
 
 const (
-	cspNonceKey   = "cspNonce"
-	cspDirsMapKey = "cspDirsMap"
+	cspNonceKey      = "cspNonce"
+	cspDirsMapKey    = "cspDirsMap"
+	cspReportOnlyKey = "cspReportOnly"
 )
 
+// Nonce returns the nonce of the present request.
+// ContentSecurityPolicy middleware must run before the handler calling Nonce, otherwise the nonce
+// is not in the CSP header. If it has not run, a nonce is generated and cached for the request
+// so all calls return the same value. Returns "" if the middleware policy does not require a nonce,
+// unless Options.AlwaysNonce is set. The middleware generates nonces with the RandReader and
+// NonceEncoding of its policy; without it there is no policy, and NewNonce() is used.
 func Nonce(c *gin.Context) string {
-	return c.GetString(cspNonceKey)
+	if v, ok := c.Get(cspNonceKey); ok {
+		return v.(string)
+	}
+
+	nonce := cspbuilder.NewNonce()
+	c.Set(cspNonceKey, nonce)
+	return nonce
 }
 
 // NonceHTMLAttr returns unescaped `nonce="<nonce>"` string for use in template.
@@ -22,6 +36,14 @@ func NonceHTMLAttr(c *gin.Context) template.HTMLAttr {
 	return template.HTMLAttr(`nonce="` + Nonce(c) + `"`)
 }
 
+// NonceFunc returns a template func that returns NonceHTMLAttr(c).
+// Register it as csp_nonce so templates can write <script {{csp_nonce}}>.
+func NonceFunc(c *gin.Context) func() template.HTMLAttr {
+	return func() template.HTMLAttr {
+		return NonceHTMLAttr(c)
+	}
+}
+
 func Directive(c *gin.Context, ds string) *cspbuilder.Directive {
 	var (
 		m  = getMap(c)
@@ -29,6 +51,7 @@ func Directive(c *gin.Context, ds string) *cspbuilder.Directive {
 		ok bool
 	)
 
+	ds = strings.ToLower(ds)
 	if d, ok = m[ds]; !ok {
 		d = &cspbuilder.Directive{}
 		m[ds] = d
@@ -44,6 +67,7 @@ func Hash(c *gin.Context, ds string, ht cspbuilder.HashType, source string) {
 		ok bool
 	)
 
+	ds = strings.ToLower(ds)
 	if d, ok = m[ds]; !ok {
 		d = &cspbuilder.Directive{}
 		m[ds] = d
@@ -67,30 +91,70 @@ func getMap(c *gin.Context) map[string]*cspbuilder.Directive {
 	return m
 }
 
+// Options configures ContentSecurityPolicyWithOptions
+type Options struct {
+	// ReportOnly sets Content-Security-Policy-Report-Only header. pol.ReportOnly also sets it.
+	ReportOnly bool
+
+	// AlwaysNonce generates a nonce for every request before the header is set, even if pol has
+	// no nonce placeholder, for templates that always render nonce attributes. The nonce is in the
+	// header only if pol or a PolicyFor policy has a placeholder.
+	AlwaysNonce bool
+}
+
 // ContentSecurityPolicy implements the gin.HandlerFunc. Does not support dynamically calculated hashes
-// reportOnly sets Content-Security-Policy-Report-Only header
+// reportOnly or pol.ReportOnly sets Content-Security-Policy-Report-Only header
+// Report-To and Reporting-Endpoints headers are set if pol has ReportEndpoints.
+// The nonce key is always set: Nonce(c) returns "" if pol does not require a nonce.
 func ContentSecurityPolicy(pol *cspbuilder.Policy, reportOnly bool) gin.HandlerFunc {
-	header := "Content-Security-Policy"
-	if reportOnly {
-		header += "-Report-Only"
+	return ContentSecurityPolicyWithOptions(pol, Options{ReportOnly: reportOnly})
+}
+
+// ContentSecurityPolicyWithOptions is ContentSecurityPolicy configured by opts.
+func ContentSecurityPolicyWithOptions(pol *cspbuilder.Policy, opts Options) gin.HandlerFunc {
+	if pol == nil {
+		panic("cspbuilder: nil policy")
+	}
+
+	reportOnly := opts.ReportOnly || pol.ReportOnly
+	pol.Build()
+
+	return func(c *gin.Context) {
+		c.Set(cspReportOnlyKey, reportOnly)
+		setPolicy(c, pol, reportOnly, opts.AlwaysNonce)
+		c.Next()
+	}
+}
+
+// PolicyFor replaces the policy set by ContentSecurityPolicy for a route or group.
+// The nonce already generated for the request is reused. The header is Report-Only if
+// the outer middleware sets it or pol.ReportOnly.
+func PolicyFor(pol *cspbuilder.Policy) gin.HandlerFunc {
+	if pol == nil {
+		panic("cspbuilder: nil policy")
 	}
 
 	pol.Build()
 
 	return func(c *gin.Context) {
-		var (
-			nonce  string
-			cspStr = pol.Compiled
-		)
-
-		if pol.RequireNonce {
-			cspStr = pol.WithNonce(&nonce)
-			c.Set(cspNonceKey, nonce)
-		} else if cspStr == "" {
-			cspStr = pol.Build()
-		}
-
-		c.Header(header, cspStr)
+		reportOnly := c.GetBool(cspReportOnlyKey) || pol.ReportOnly
+
+		c.Header(cspbuilder.HeaderName(false), "")
+		c.Header("Report-To", "")
+		c.Header("Reporting-Endpoints", "")
+		c.Set(cspReportOnlyKey, reportOnly)
+		setPolicy(c, pol, reportOnly, false)
 		c.Next()
 	}
 }
+
+// setPolicy sets the policy header, reusing the request nonce if present
+func setPolicy(c *gin.Context, pol *cspbuilder.Policy, reportOnly, alwaysNonce bool) {
+	nonce := c.GetString(cspNonceKey)
+	if alwaysNonce && nonce == "" {
+		nonce = pol.NewNonce()
+	}
+
+	pol.SetHeader(c.Writer.Header(), reportOnly, &nonce)
+	c.Set(cspNonceKey, nonce)
+}
@@ -1,6 +1,8 @@
 package gincsp_test
 
 import (
+	"bytes"
+	"encoding/base64"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
@@ -51,3 +53,200 @@ func TestCsp(t *testing.T) {
 		t.Fatal("want 'sha512-JmJZZcyblZQCHlZRsKDDtflAYSRkis0qyVDld8GYYgE33OHeq29ups1mbWGRG5YsUJA8XlUFLdqMMpEYX5m9WA=='", "got", cspStr)
 	}
 }
+
+func TestPolicyReportOnly(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+	csp.ReportOnly = true
+
+	router := gin.New()
+	router.Use(gincsp.ContentSecurityPolicy(csp, false))
+	router.GET("/foo", func(c *gin.Context) {
+		c.String(http.StatusOK, "")
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	router.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy-Report-Only"); s != "script-src 'self'" {
+		t.Fatal("want script-src 'self' got", s)
+	}
+
+	if s := res.Header().Get("Content-Security-Policy"); s != "" {
+		t.Fatal("want no enforcing header got", s)
+	}
+}
+
+func TestReportToHeader(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+	csp.SetReportTo("csp-endpoint", "https://example.com/_csp-report", 86400)
+
+	router := gin.New()
+	router.Use(gincsp.ContentSecurityPolicy(csp, false))
+	router.GET("/foo", func(c *gin.Context) {
+		c.String(http.StatusOK, "")
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	router.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); !strings.Contains(s, "report-to csp-endpoint") {
+		t.Fatal("want report-to csp-endpoint got", s)
+	}
+
+	if s := res.Header().Get("Report-To"); !strings.Contains(s, `"group":"csp-endpoint"`) {
+		t.Fatal("want Report-To header got", s)
+	}
+}
+
+func TestNonceWithoutMiddleware(t *testing.T) {
+	var a, b string
+
+	router := gin.New()
+	router.GET("/foo", func(c *gin.Context) {
+		a = gincsp.Nonce(c)
+		b = gincsp.Nonce(c)
+		c.String(http.StatusOK, "")
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	router.ServeHTTP(res, req)
+
+	if a == "" || a != b {
+		t.Fatal("want same non-empty nonce got", a, b)
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "cspbuilder: nil policy" {
+			t.Fatal("want cspbuilder: nil policy got", r)
+		}
+	}()
+
+	gincsp.ContentSecurityPolicy(nil, false)
+}
+
+func TestNonceNotRequired(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+
+	for _, always := range []bool{false, true} {
+		var nonce string
+
+		router := gin.New()
+		router.Use(gincsp.ContentSecurityPolicyWithOptions(csp, gincsp.Options{AlwaysNonce: always}))
+		router.GET("/foo", func(c *gin.Context) {
+			nonce = gincsp.Nonce(c)
+			c.String(http.StatusOK, "")
+		})
+
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/foo", nil)
+
+		router.ServeHTTP(res, req)
+
+		if s := res.Header().Get("Content-Security-Policy"); s != "script-src 'self'" {
+			t.Fatal("want script-src 'self' got", s)
+		}
+
+		if always != (nonce != "") {
+			t.Fatal("want nonce", always, "got", nonce)
+		}
+	}
+}
+
+func TestAlwaysNonceHeader(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	var nonce string
+
+	router := gin.New()
+	router.Use(gincsp.ContentSecurityPolicyWithOptions(csp, gincsp.Options{AlwaysNonce: true}))
+	router.GET("/foo", func(c *gin.Context) {
+		nonce = gincsp.Nonce(c)
+		c.String(http.StatusOK, "")
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	router.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); nonce == "" || s != "script-src 'self' 'nonce-"+nonce+"'" {
+		t.Fatal("want script-src 'self' 'nonce-"+nonce+"' got", s)
+	}
+}
+
+func TestNonceEncoding(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+	csp.NonceEncoding = base64.StdEncoding
+	csp.RandReader = bytes.NewReader(bytes.Repeat([]byte{0xff}, 16))
+
+	var nonce string
+
+	router := gin.New()
+	router.Use(gincsp.ContentSecurityPolicyWithOptions(csp, gincsp.Options{AlwaysNonce: true}))
+	router.GET("/foo", func(c *gin.Context) {
+		nonce = gincsp.Nonce(c)
+		c.String(http.StatusOK, "")
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	router.ServeHTTP(res, req)
+
+	if nonce != "/////////////////////w==" {
+		t.Fatal("want /////////////////////w== got", nonce)
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	admin := cspbuilder.New()
+	admin.New(cspbuilder.Script, cspbuilder.None)
+	admin.New(cspbuilder.Style, cspbuilder.Nonce)
+
+	var nonce string
+
+	router := gin.New()
+	router.Use(gincsp.ContentSecurityPolicy(csp, false))
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, "")
+	})
+
+	group := router.Group("/admin", gincsp.PolicyFor(admin))
+	group.GET("/", func(c *gin.Context) {
+		nonce = gincsp.Nonce(c)
+		c.String(http.StatusOK, "")
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	router.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); !strings.HasPrefix(s, "script-src 'self' 'nonce-") {
+		t.Fatal("want script-src 'self' 'nonce-... got", s)
+	}
+
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/admin/", nil)
+	router.ServeHTTP(res, req)
+
+	s := res.Header().Get("Content-Security-Policy")
+	if strings.Contains(s, "'self'") || !strings.Contains(s, "script-src 'none'") || !strings.Contains(s, "style-src 'nonce-"+nonce+"'") {
+		t.Fatal("want admin policy with nonce", nonce, "got", s)
+	}
+}
@@ -2,12 +2,16 @@
 package csphandler
 
 import (
+	"context"
 	"html/template"
 	"net/http"
+	"strings"
 
 	"github.com/jaynzr/cspbuilder"
 )
 
+type policyKey struct{}
+
 type cspValueSetter interface {
 	set(key string, value *cspbuilder.Directive)
 	get(ds string) *cspbuilder.Directive
@@ -25,7 +29,7 @@ func (w *cspResponseWriter) set(key string, d *cspbuilder.Directive) {
 		w.m = map[string]*cspbuilder.Directive{}
 	}
 
-	w.m[key] = d
+	w.m[strings.ToLower(key)] = d
 }
 
 func (w *cspResponseWriter) get(ds string) *cspbuilder.Directive {
@@ -38,6 +42,7 @@ func (w *cspResponseWriter) get(ds string) *cspbuilder.Directive {
 		w.m = make(map[string]*cspbuilder.Directive)
 	}
 
+	ds = strings.ToLower(ds)
 	if d, ok = w.m[ds]; !ok {
 		d = &cspbuilder.Directive{}
 		w.m[ds] = d
@@ -65,6 +70,30 @@ func NonceHTMLAttr(w http.ResponseWriter) template.HTMLAttr {
 	return template.HTMLAttr(`nonce="` + Nonce(w) + `"`)
 }
 
+// NonceFunc returns a template func that returns NonceHTMLAttr(w).
+func NonceFunc(w http.ResponseWriter) func() template.HTMLAttr {
+	return func() template.HTMLAttr {
+		return NonceHTMLAttr(w)
+	}
+}
+
+// TemplateFuncs registers a placeholder csp_nonce func, so templates calling {{csp_nonce}} can be parsed.
+// Use Template() to bind csp_nonce to a response.
+var TemplateFuncs = template.FuncMap{
+	"csp_nonce": func() template.HTMLAttr { return "" },
+}
+
+// Template returns a clone of t with csp_nonce bound to the nonce of w.
+// t must be parsed with TemplateFuncs.
+func Template(t *template.Template, w http.ResponseWriter) (*template.Template, error) {
+	t, err := t.Clone()
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Funcs(template.FuncMap{"csp_nonce": NonceFunc(w)}), nil
+}
+
 func Directive(w http.ResponseWriter, ds string) *cspbuilder.Directive {
 	setter, ok := w.(cspValueSetter)
 	if ok {
@@ -78,42 +107,130 @@ func Hash(w http.ResponseWriter, ds string, ht cspbuilder.HashType, source strin
 	d.Hash(ht, source)
 }
 
+// WithPolicy returns a copy of ctx carrying pol.
+// ContentSecurityPolicy uses pol instead of its default policy for requests with this context.
+// pol is built once on first use if Build() has not run, so it can be shared by concurrent requests.
+func WithPolicy(ctx context.Context, pol *cspbuilder.Policy) context.Context {
+	return context.WithValue(ctx, policyKey{}, pol)
+}
+
+// Options configures ContentSecurityPolicyWithOptions
+type Options struct {
+	// ReportOnly sets Content-Security-Policy-Report-Only header. pol.ReportOnly also sets it.
+	ReportOnly bool
+
+	// Trailer declares the CSP header as a trailer and sets it only after the handler runs,
+	// including hashes added with Hash() and Directive(). Browsers effectively do not
+	// support CSP in trailers; this is for tooling and proxies.
+	Trailer bool
+
+	// SkipFunc skips setting CSP headers for requests it returns true for, e.g. health checks
+	// and static assets. Nonce() returns "" in skipped requests.
+	SkipFunc func(*http.Request) bool
+
+	// LegacyHeaders also sets X-Content-Security-Policy and X-WebKit-CSP with the same value,
+	// for very old clients and embedded webviews.
+	LegacyHeaders bool
+}
+
 // ContentSecurityPolicy implements the http.HandlerFunc for integration with the standard net/http lib.
-// reportOnly sets Content-Security-Policy-Report-Only header
+// reportOnly or pol.ReportOnly sets Content-Security-Policy-Report-Only header
+// Report-To and Reporting-Endpoints headers are set if pol has ReportEndpoints.
 func ContentSecurityPolicy(pol *cspbuilder.Policy, h http.Handler, reportOnly bool) http.Handler {
-	header := "Content-Security-Policy"
-	if reportOnly {
-		header += "-Report-Only"
+	return ContentSecurityPolicyWithOptions(pol, h, Options{ReportOnly: reportOnly})
+}
+
+// ContentSecurityPolicyWithOptions is ContentSecurityPolicy configured by opts.
+func ContentSecurityPolicyWithOptions(pol *cspbuilder.Policy, h http.Handler, opts Options) http.Handler {
+	if pol == nil {
+		panic("cspbuilder: nil policy")
 	}
 
 	pol.Build()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-		cspStr := pol.Compiled
 		cr := &cspResponseWriter{
 			ResponseWriter: w,
 		}
 
-		if pol.RequireNonce {
-			cspStr = pol.WithNonce(&cr.n)
-		} else if cspStr == "" {
-			cspStr = pol.Build()
+		if opts.SkipFunc != nil && opts.SkipFunc(r) {
+			h.ServeHTTP(cr, r)
+			return
+		}
+
+		p := pol
+		if ctxPol, ok := r.Context().Value(policyKey{}).(*cspbuilder.Policy); ok {
+			p = ctxPol
+		}
+
+		header := cspbuilder.HeaderName(opts.ReportOnly || p.ReportOnly)
+		p.SetHeader(cr.Header(), opts.ReportOnly, &cr.n)
+
+		if opts.Trailer {
+			// only the merged policy is sent, as a trailer, so clients do not receive two policies
+			cr.Header().Del(header)
+			cr.Header().Add("Trailer", header)
+
+			if opts.LegacyHeaders {
+				for _, name := range legacyHeaders(header) {
+					cr.Header().Add("Trailer", name)
+				}
+			}
+		} else if opts.LegacyHeaders {
+			setLegacyHeaders(cr.Header(), header)
 		}
 
-		cr.Header().Set(header, cspStr)
 		h.ServeHTTP(cr, r)
 
-		// TODO: csp header can't be issued after body is written.
-		// Untested workaround: issue `Trailer: Content-Security-Policy` header before `h.ServeHTTP(cr, r)`
-		/* if len(cr.m) > 0 {
-			cspStr = pol.MergeBuild(cr.m)
+		// csp header can't be issued after body is written.
+		if opts.Trailer {
+			p.SetMergedHeader(cr.Header(), opts.ReportOnly, &cr.n, cr.m)
 
-			if len(cr.n) > 0 {
-				cspStr = strings.ReplaceAll(cspStr, cspbuilder.Nonce, "'nonce-"+cr.n+"'")
+			if opts.LegacyHeaders {
+				setLegacyHeaders(cr.Header(), header)
 			}
 		}
+	})
+}
+
+// ContentSecurityPolicyDual sets both Content-Security-Policy and Content-Security-Policy-Report-Only headers.
+// The same nonce is substituted into both policies so inline scripts satisfy both.
+// Report-To and Reporting-Endpoints are set from both policies, enforce taking precedence.
+func ContentSecurityPolicyDual(enforce, report *cspbuilder.Policy, h http.Handler) http.Handler {
+	if enforce == nil || report == nil {
+		panic("cspbuilder: nil policy")
+	}
+
+	if enforce.ReportOnly {
+		panic("cspbuilder: enforce policy is ReportOnly")
+	}
+
+	enforce.Build()
+	report.Build()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := &cspResponseWriter{
+			ResponseWriter: w,
+		}
 
-		cr.Header().Set(header, cspStr) */
+		report.SetHeader(cr.Header(), true, &cr.n)
+		enforce.SetHeader(cr.Header(), false, &cr.n)
+		h.ServeHTTP(cr, r)
 	})
 }
+
+// setLegacyHeaders copies the header value to the X-Content-Security-Policy and X-WebKit-CSP headers
+func setLegacyHeaders(h http.Header, header string) {
+	v := h.Get(header)
+
+	for _, name := range legacyHeaders(header) {
+		h.Set(name, v)
+	}
+}
+
+// legacyHeaders returns the X-Content-Security-Policy and X-WebKit-CSP names matching header
+func legacyHeaders(header string) []string {
+	suffix := strings.TrimPrefix(header, "Content-Security-Policy")
+	return []string{"X-Content-Security-Policy" + suffix, "X-WebKit-CSP" + suffix}
+}
@@ -1,10 +1,14 @@
 package csphandler_test
 
 import (
+	"fmt"
+	"html/template"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/jaynzr/cspbuilder"
@@ -45,3 +49,397 @@ func TestCsp(t *testing.T) {
 		t.Fatal("want 'sha512-JmJZZcyblZQCHlZRsKDDtflAYSRkis0qyVDld8GYYgE33OHeq29ups1mbWGRG5YsUJA8XlUFLdqMMpEYX5m9WA=='", "got", cspStr)
 	}
 }
+
+func TestCspDual(t *testing.T) {
+	re := regexp.MustCompile(`nonce-(.+?)'`)
+
+	enforce := cspbuilder.New()
+	enforce.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	report := cspbuilder.New()
+	report.New(cspbuilder.Script, cspbuilder.Nonce, cspbuilder.StrictDynamic)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	csphandler.ContentSecurityPolicyDual(enforce, report, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<script nonce="` + csphandler.Nonce(w) + `"></script>`))
+	})).ServeHTTP(res, req)
+
+	enforceStr := res.Header().Get("Content-Security-Policy")
+	reportStr := res.Header().Get("Content-Security-Policy-Report-Only")
+
+	em := re.FindStringSubmatch(enforceStr)
+	rm := re.FindStringSubmatch(reportStr)
+
+	if len(em) != 2 || len(rm) != 2 || em[1] != rm[1] {
+		t.Fatal("want same nonce got", enforceStr, reportStr)
+	}
+
+	if !strings.Contains(res.Body.String(), `nonce="`+em[1]+`"`) {
+		t.Fatal("nonce not found", res.Body.String())
+	}
+}
+
+func TestCspDualReportTo(t *testing.T) {
+	enforce := cspbuilder.New()
+	enforce.New(cspbuilder.Script, cspbuilder.Self)
+
+	report := cspbuilder.New()
+	report.New(cspbuilder.Script, cspbuilder.StrictDynamic)
+	report.SetReportTo("csp-endpoint", "https://example.com/csp", 86400)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	csphandler.ContentSecurityPolicyDual(enforce, report, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(res, req)
+
+	if s := res.Header().Get("Reporting-Endpoints"); s != `csp-endpoint="https://example.com/csp"` {
+		t.Fatal("want", `csp-endpoint="https://example.com/csp"`, "got", s)
+	}
+
+	if s := res.Header().Get("Report-To"); !strings.Contains(s, "https://example.com/csp") {
+		t.Fatal("want Report-To with https://example.com/csp got", s)
+	}
+}
+
+func TestWithPolicy(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+
+	override := cspbuilder.New()
+	override.New(cspbuilder.Script, "cdn.example.com")
+
+	h := csphandler.ContentSecurityPolicy(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), false)
+	tenant := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(csphandler.WithPolicy(r.Context(), override)))
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	h.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); s != "script-src 'self'" {
+		t.Fatal("want script-src 'self' got", s)
+	}
+
+	res = httptest.NewRecorder()
+	tenant.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); s != "script-src cdn.example.com" {
+		t.Fatal("want script-src cdn.example.com got", s)
+	}
+}
+
+// run with -race: requests sharing an unbuilt context policy must not build it concurrently
+func TestWithPolicyParallel(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+
+	tenant := cspbuilder.New()
+	tenant.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+	tenant.SetReportTo("csp-endpoint", "https://example.com/_csp-report", 86400)
+
+	h := csphandler.ContentSecurityPolicy(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), false)
+
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan string, 8)
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			res := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/foo", nil)
+			h.ServeHTTP(res, req.WithContext(csphandler.WithPolicy(req.Context(), tenant)))
+
+			if s := res.Header().Get("Content-Security-Policy"); !strings.HasPrefix(s, "script-src 'self' 'nonce-") {
+				errs <- s
+			}
+
+			if s := res.Header().Get("Reporting-Endpoints"); s == "" {
+				errs <- "no Reporting-Endpoints"
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for s := range errs {
+		t.Fatal("want script-src 'self' 'nonce-... with Reporting-Endpoints got", s)
+	}
+}
+
+func TestPolicyReportOnly(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+	csp.ReportOnly = true
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	csphandler.ContentSecurityPolicy(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), false).ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy-Report-Only"); s != "script-src 'self'" {
+		t.Fatal("want script-src 'self' got", s)
+	}
+
+	if s := res.Header().Get("Content-Security-Policy"); s != "" {
+		t.Fatal("want no enforcing header got", s)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	re := regexp.MustCompile(`nonce-(.+?)'`)
+	tmpl := template.Must(template.New("").Funcs(csphandler.TemplateFuncs).Parse(`<script {{csp_nonce}}></script>`))
+
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Nonce)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	csphandler.ContentSecurityPolicy(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tmpl, err := csphandler.Template(tmpl, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tmpl.Execute(w, nil); err != nil {
+			t.Fatal(err)
+		}
+	}), false).ServeHTTP(res, req)
+
+	matches := re.FindStringSubmatch(res.Header().Get("Content-Security-Policy"))
+
+	if len(matches) != 2 || res.Body.String() != `<script nonce="`+matches[1]+`"></script>` {
+		t.Fatal("nonce not found", matches, res.Body.String())
+	}
+}
+
+func TestReportToHeader(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+	csp.ReportURI = "/_csp-report"
+
+	h := csphandler.ContentSecurityPolicy(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), false)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	h.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Report-To"); s != "" {
+		t.Fatal("want no Report-To got", s)
+	}
+
+	csp.SetReportTo("csp-endpoint", "https://example.com/_csp-report", 86400)
+	h = csphandler.ContentSecurityPolicy(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), false)
+
+	res = httptest.NewRecorder()
+	h.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); !strings.Contains(s, "report-to csp-endpoint") {
+		t.Fatal("want report-to csp-endpoint got", s)
+	}
+
+	if s := res.Header().Get("Report-To"); !strings.Contains(s, `"group":"csp-endpoint"`) {
+		t.Fatal("want Report-To header got", s)
+	}
+	if s := res.Header().Get("Reporting-Endpoints"); s != `csp-endpoint="https://example.com/_csp-report"` {
+		t.Fatal(`want csp-endpoint="https://example.com/_csp-report" got`, s)
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	srv := httptest.NewServer(csphandler.ContentSecurityPolicyWithOptions(csp, handler, csphandler.Options{Trailer: true, LegacyHeaders: true}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// trailers are available once the body is read
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Content-Security-Policy", "X-Content-Security-Policy", "X-WebKit-CSP"} {
+		if s := resp.Header.Get(name); s != "" {
+			t.Fatal("want no", name, "header got", s)
+		}
+	}
+
+	trailer := resp.Trailer.Get("Content-Security-Policy")
+
+	if !strings.Contains(trailer, "'sha512-JmJZZcyblZQCHlZRsKDDtflAYSRkis0qyVDld8GYYgE33OHeq29ups1mbWGRG5YsUJA8XlUFLdqMMpEYX5m9WA=='") {
+		t.Fatal("want hash in trailer got", trailer)
+	}
+
+	if !strings.Contains(trailer, "'nonce-"+regexp.MustCompile(`nonce="(.+?)"`).FindStringSubmatch(string(body))[1]+"'") {
+		t.Fatal("want nonce in trailer got", trailer, string(body))
+	}
+
+	if s := resp.Trailer.Get("X-WebKit-CSP"); s != trailer {
+		t.Fatal("want", trailer, "got", s)
+	}
+}
+
+func TestDirectiveCase(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	csphandler.ContentSecurityPolicyWithOptions(csp, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		csphandler.Hash(w, "Script-Src", cspbuilder.SHA512, "doSomething();")
+	}), csphandler.Options{Trailer: true}).ServeHTTP(res, req)
+
+	want := "script-src 'self' 'sha512-JmJZZcyblZQCHlZRsKDDtflAYSRkis0qyVDld8GYYgE33OHeq29ups1mbWGRG5YsUJA8XlUFLdqMMpEYX5m9WA=='"
+	if s := res.Result().Trailer.Get("Content-Security-Policy"); s != want {
+		t.Fatal("want", want, "got", s)
+	}
+}
+
+func TestNilPolicy(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "cspbuilder: nil policy" {
+			t.Fatal("want cspbuilder: nil policy got", r)
+		}
+	}()
+
+	csphandler.ContentSecurityPolicy(nil, handler, false)
+}
+
+func TestSkipFunc(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	h := csphandler.ContentSecurityPolicyWithOptions(csp, handler, csphandler.Options{
+		SkipFunc: func(r *http.Request) bool { return r.URL.Path == "/healthz" },
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	h.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); s != "" {
+		t.Fatal("want no header got", s)
+	}
+
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); !strings.HasPrefix(s, "script-src 'self' 'nonce-") {
+		t.Fatal("want script-src 'self' 'nonce-... got", s)
+	}
+}
+
+func TestLegacyHeaders(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+
+	csphandler.ContentSecurityPolicyWithOptions(csp, handler, csphandler.Options{LegacyHeaders: true}).ServeHTTP(res, req)
+
+	want := res.Header().Get("Content-Security-Policy")
+	if !strings.Contains(want, "'nonce-") {
+		t.Fatal("want nonce policy got", want)
+	}
+
+	for _, name := range []string{"X-Content-Security-Policy", "X-WebKit-CSP"} {
+		if s := res.Header().Get(name); s != want {
+			t.Fatal("want", want, "got", name, s)
+		}
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self)
+	csp.ReportURI = "/_csp-report"
+
+	h := csphandler.ContentSecurityPolicy(csp, handler, false)
+
+	serve := func() string {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/foo", nil)
+		h.ServeHTTP(res, req)
+		return res.Header().Get("Content-Security-Policy")
+	}
+
+	if s := serve(); s != "script-src 'self';report-uri /_csp-report" {
+		t.Fatal("want script-src 'self';report-uri /_csp-report got", s)
+	}
+
+	csp.ReportURI = "https://staging.example.com/_csp-report"
+	csp.Invalidate()
+
+	if s := serve(); s != "script-src 'self';report-uri https://staging.example.com/_csp-report" {
+		t.Fatal("want script-src 'self';report-uri https://staging.example.com/_csp-report got", s)
+	}
+}
+
+// run with -race: Invalidate swaps the policy while requests are served
+func TestInvalidateParallel(t *testing.T) {
+	csp := cspbuilder.New()
+	csp.New(cspbuilder.Script, cspbuilder.Self, cspbuilder.Nonce)
+	csp.ReportURI = "/_csp-report"
+
+	handlers := []http.Handler{
+		csphandler.ContentSecurityPolicy(csp, handler, false),
+		csphandler.ContentSecurityPolicyWithOptions(csp, handler, csphandler.Options{Trailer: true}),
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(h http.Handler) {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				req, _ := http.NewRequest("GET", "/foo", nil)
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		}(handlers[i%len(handlers)])
+	}
+
+	for i := 0; i < 50; i++ {
+		csp.ReportURI = fmt.Sprintf("/_csp-report/%d", i)
+		csp.Invalidate()
+	}
+
+	close(done)
+	wg.Wait()
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/foo", nil)
+	handlers[0].ServeHTTP(res, req)
+
+	if s := res.Header().Get("Content-Security-Policy"); !strings.HasSuffix(s, "report-uri /_csp-report/49") {
+		t.Fatal("want report-uri /_csp-report/49 got", s)
+	}
+}
@@ -0,0 +1,158 @@
+// Package cspreport receives Content Security Policy violation reports
+package cspreport
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// maxBodySize limits the report body read by ReportHandler
+const maxBodySize = 64 << 10
+
+// Report is a CSP violation report
+type Report struct {
+	DocumentURI        string `json:"document-uri"`
+	Referrer           string `json:"referrer"`
+	ViolatedDirective  string `json:"violated-directive"`
+	EffectiveDirective string `json:"effective-directive"`
+	OriginalPolicy     string `json:"original-policy"`
+	BlockedURI         string `json:"blocked-uri"`
+	LineNumber         int    `json:"line-number"`
+	ColumnNumber       int    `json:"column-number"`
+	SourceFile         string `json:"source-file"`
+	StatusCode         int    `json:"status-code"`
+	ScriptSample       string `json:"script-sample"`
+	Disposition        string `json:"disposition"`
+}
+
+// legacyReport is the application/csp-report body
+type legacyReport struct {
+	Report *Report `json:"csp-report"`
+}
+
+// apiReport is a Reporting API application/reports+json entry
+type apiReport struct {
+	Type string        `json:"type"`
+	Body apiReportBody `json:"body"`
+}
+
+type apiReportBody struct {
+	DocumentURL        string `json:"documentURL"`
+	Referrer           string `json:"referrer"`
+	EffectiveDirective string `json:"effectiveDirective"`
+	OriginalPolicy     string `json:"originalPolicy"`
+	BlockedURL         string `json:"blockedURL"`
+	LineNumber         int    `json:"lineNumber"`
+	ColumnNumber       int    `json:"columnNumber"`
+	SourceFile         string `json:"sourceFile"`
+	StatusCode         int    `json:"statusCode"`
+	Sample             string `json:"sample"`
+	Disposition        string `json:"disposition"`
+}
+
+func (b *apiReportBody) report() Report {
+	return Report{
+		DocumentURI:        b.DocumentURL,
+		Referrer:           b.Referrer,
+		ViolatedDirective:  b.EffectiveDirective,
+		EffectiveDirective: b.EffectiveDirective,
+		OriginalPolicy:     b.OriginalPolicy,
+		BlockedURI:         b.BlockedURL,
+		LineNumber:         b.LineNumber,
+		ColumnNumber:       b.ColumnNumber,
+		SourceFile:         b.SourceFile,
+		StatusCode:         b.StatusCode,
+		ScriptSample:       b.Sample,
+		Disposition:        b.Disposition,
+	}
+}
+
+// ReportHandler parses application/csp-report and application/reports+json request bodies
+// and calls fn for each CSP violation report. Responds 204 No Content on success.
+func ReportHandler(fn func(Report)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		reports, err := parseReports(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		for _, rep := range reports {
+			fn(rep)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// ParseReport decodes a single CSP violation report from r. r may hold a legacy
+// {"csp-report": {...}} object, a Reporting API entry or an array of entries,
+// in which case the first csp-violation is returned.
+func ParseReport(r io.Reader) (Report, error) {
+	reports, err := parseReports(r)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if len(reports) == 0 {
+		return Report{}, ErrNoReport
+	}
+	return reports[0], nil
+}
+
+// ErrNoReport is returned by ParseReport when the body holds no csp-violation report
+var ErrNoReport = errors.New("cspreport: no csp-violation report")
+
+// parseReports decodes a legacy csp-report object, a Reporting API entry or an array of entries
+func parseReports(r io.Reader) ([]Report, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errors.New("cspreport: empty body")
+	}
+
+	if b[0] == '[' {
+		var entries []apiReport
+		if err := json.Unmarshal(b, &entries); err != nil {
+			return nil, err
+		}
+
+		reports := make([]Report, 0, len(entries))
+		for i := range entries {
+			if entries[i].Type == "csp-violation" {
+				reports = append(reports, entries[i].Body.report())
+			}
+		}
+		return reports, nil
+	}
+
+	var v struct {
+		legacyReport
+		apiReport
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+
+	if v.Report != nil {
+		return []Report{*v.Report}, nil
+	}
+
+	if v.Type == "csp-violation" {
+		return []Report{v.Body.report()}, nil
+	}
+	return nil, nil
+}
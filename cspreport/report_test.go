@@ -0,0 +1,120 @@
+package cspreport_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jaynzr/cspbuilder/cspreport"
+)
+
+const legacyBody = `{"csp-report":{"document-uri":"https://example.com/","referrer":"","violated-directive":"script-src-elem","effective-directive":"script-src-elem","original-policy":"script-src 'self'; report-uri /_csp-report","disposition":"enforce","blocked-uri":"https://evil.example.com/x.js"}}`
+
+const apiBody = `[{"type":"csp-violation","age":10,"url":"https://example.com/","user_agent":"Mozilla/5.0","body":{"documentURL":"https://example.com/","referrer":"","effectiveDirective":"img-src","originalPolicy":"img-src 'self'; report-to csp-endpoint","disposition":"report","blockedURL":"https://img.example.com/a.png","statusCode":200}},{"type":"deprecation","body":{}}]`
+
+func serve(t *testing.T, contentType, body string) ([]cspreport.Report, int) {
+	var reports []cspreport.Report
+
+	h := cspreport.ReportHandler(func(r cspreport.Report) {
+		reports = append(reports, r)
+	})
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/_csp-report", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+
+	h.ServeHTTP(res, req)
+	return reports, res.Code
+}
+
+func TestLegacyReport(t *testing.T) {
+	reports, code := serve(t, "application/csp-report", legacyBody)
+
+	if code != http.StatusNoContent || len(reports) != 1 {
+		t.Fatal("want 1 report got", code, reports)
+	}
+
+	r := reports[0]
+	if r.BlockedURI != "https://evil.example.com/x.js" || r.ViolatedDirective != "script-src-elem" || r.DocumentURI != "https://example.com/" || r.Disposition != "enforce" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
+
+func TestReportingAPIReport(t *testing.T) {
+	reports, code := serve(t, "application/reports+json", apiBody)
+
+	if code != http.StatusNoContent || len(reports) != 1 {
+		t.Fatal("want 1 report got", code, reports)
+	}
+
+	r := reports[0]
+	if r.BlockedURI != "https://img.example.com/a.png" || r.EffectiveDirective != "img-src" || r.DocumentURI != "https://example.com/" || r.Disposition != "report" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
+
+func TestBadReport(t *testing.T) {
+	if reports, code := serve(t, "application/csp-report", `{"csp-report":`); code != http.StatusBadRequest || len(reports) != 0 {
+		t.Fatal("want 400 got", code, reports)
+	}
+}
+
+func TestParseReport(t *testing.T) {
+	r, err := cspreport.ParseReport(strings.NewReader(`{"csp-report":{"document-uri":"https://example.com/","violated-directive":"script-src","blocked-uri":"inline","line-number":12,"column-number":4,"source-file":"https://example.com/app.js","status-code":200,"script-sample":"alert(1)"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.LineNumber != 12 || r.ColumnNumber != 4 || r.SourceFile != "https://example.com/app.js" || r.StatusCode != 200 || r.ScriptSample != "alert(1)" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+
+	r, err = cspreport.ParseReport(strings.NewReader(`{"type":"csp-violation","body":{"effectiveDirective":"script-src-elem","blockedURL":"inline","lineNumber":3,"sample":"eval()"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.EffectiveDirective != "script-src-elem" || r.LineNumber != 3 || r.ScriptSample != "eval()" {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
+
+func TestParseReportMalformed(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`{"csp-report":`,
+		`{"csp-report":{"line-number":"12"}}`,
+		`[{"type":"csp-violation","body":[]}]`,
+		`not json`,
+	} {
+		if _, err := cspreport.ParseReport(strings.NewReader(body)); err == nil {
+			t.Fatal("want error for", body)
+		}
+	}
+
+	if _, err := cspreport.ParseReport(strings.NewReader(`[{"type":"deprecation","body":{}}]`)); err != cspreport.ErrNoReport {
+		t.Fatal("want", cspreport.ErrNoReport, "got", err)
+	}
+}
+
+func TestSuggestFromReports(t *testing.T) {
+	s := cspreport.SuggestFromReports([]cspreport.Report{
+		{EffectiveDirective: "script-src-elem", BlockedURI: "https://cdn.example.com/lib.js?v=2"},
+		{EffectiveDirective: "script-src-elem", BlockedURI: "https://cdn.example.com/other.js"},
+		{ViolatedDirective: "img-src 'self'", BlockedURI: "data:image/png;base64,AAAA"},
+		{EffectiveDirective: "script-src", BlockedURI: "inline"},
+	})
+
+	if len(s) != 2 {
+		t.Fatal("want 2 directives got", s)
+	}
+
+	if v := s["script-src-elem"]; len(v) != 1 || v[0] != "https://cdn.example.com" {
+		t.Fatal("want https://cdn.example.com got", v)
+	}
+
+	if v := s["img-src"]; len(v) != 1 || v[0] != "data:" {
+		t.Fatal("want data: got", v)
+	}
+}
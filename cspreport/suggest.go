@@ -0,0 +1,61 @@
+package cspreport
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// SuggestFromReports maps the effective directive of each report to the sorted
+// set of blocked origins (scheme+host) seen. Inline and eval violations are skipped;
+// they are not fixed by allowing a source.
+func SuggestFromReports(reports []Report) map[string][]string {
+	seen := map[string]map[string]bool{}
+
+	for i := range reports {
+		name := reports[i].EffectiveDirective
+		if name == "" {
+			name = reports[i].ViolatedDirective
+		}
+
+		// older browsers report the full directive value
+		if j := strings.IndexByte(name, ' '); j >= 0 {
+			name = name[:j]
+		}
+
+		origin := blockedOrigin(reports[i].BlockedURI)
+		if name == "" || origin == "" {
+			continue
+		}
+
+		if seen[name] == nil {
+			seen[name] = map[string]bool{}
+		}
+		seen[name][origin] = true
+	}
+
+	suggestions := make(map[string][]string, len(seen))
+	for name, origins := range seen {
+		srcs := make([]string, 0, len(origins))
+		for o := range origins {
+			srcs = append(srcs, o)
+		}
+		sort.Strings(srcs)
+		suggestions[name] = srcs
+	}
+
+	return suggestions
+}
+
+// blockedOrigin collapses blocked-uri to scheme://host, or scheme: for hostless urls
+func blockedOrigin(blocked string) string {
+	u, err := url.Parse(blocked)
+	if err != nil || u.Scheme == "" {
+		return ""
+	}
+
+	if u.Host == "" {
+		return u.Scheme + ":"
+	}
+	return u.Scheme + "://" + u.Host
+}
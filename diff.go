@@ -0,0 +1,112 @@
+package cspbuilder
+
+import (
+	"sort"
+	"strings"
+)
+
+// Diff returns human readable changes from oldPol to newPol, sorted by directive name.
+//
+//	"+ script-src cdn.new.com"       directive added
+//	"- img-src old.cdn.com"          directive removed
+//	"~ style-src: +'unsafe-inline'"  sources added or removed
+//
+// report-uri, upgrade-insecure-requests and block-all-mixed-content are compared as directives.
+func Diff(oldPol, newPol *Policy) []string {
+	var (
+		lines []string
+		om    = oldPol.diffMap()
+		nm    = newPol.diffMap()
+		names = make([]string, 0, len(om)+len(nm))
+	)
+
+	for name := range om {
+		names = append(names, name)
+	}
+
+	for name := range nm {
+		if _, ok := om[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		before, inOld := om[name]
+		after, inNew := nm[name]
+
+		switch {
+		case !inOld:
+			lines = append(lines, strings.TrimSpace("+ "+name+" "+strings.Join(after, " ")))
+		case !inNew:
+			lines = append(lines, strings.TrimSpace("- "+name+" "+strings.Join(before, " ")))
+		default:
+			if changes := diffSources(before, after); len(changes) > 0 {
+				lines = append(lines, "~ "+name+": "+strings.Join(changes, " "))
+			}
+		}
+	}
+
+	return lines
+}
+
+// diffMap returns directive sources by name, including report-uri and flag directives
+func (pp *Policy) diffMap() map[string][]string {
+	m := make(map[string][]string, len(pp.dirs)+2)
+
+	for name, d := range pp.dirs {
+		if len(d.sources) == 0 {
+			m[name] = []string{None}
+		} else {
+			m[name] = d.sources
+		}
+	}
+
+	if pp.UpgradeInsecureRequests {
+		m[upgradeInsecureRequests] = nil
+	}
+
+	if pp.BlockAllMixedContent {
+		m[blockAllMixedContent] = nil
+	}
+
+	if reportURIs := pp.reportURIs(); reportURIs != "" {
+		m[strings.TrimSpace(reportUri)] = strings.Fields(reportURIs)
+	}
+
+	return m
+}
+
+// diffSources returns "+source" for sources only in after and "-source" for sources only in before
+func diffSources(before, after []string) []string {
+	var (
+		changes []string
+		om      = make(map[string]bool, len(before))
+		nm      = make(map[string]bool, len(after))
+	)
+
+	for _, v := range before {
+		om[v] = true
+	}
+
+	for _, v := range after {
+		nm[v] = true
+	}
+
+	for _, v := range after {
+		if !om[v] {
+			changes = append(changes, "+"+v)
+			om[v] = true
+		}
+	}
+
+	for _, v := range before {
+		if !nm[v] {
+			changes = append(changes, "-"+v)
+			nm[v] = true
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,74 @@
+package cspbuilder
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// FromStruct builds a policy from struct fields tagged with a directive name, e.g.
+//
+//	type Config struct {
+//		Script  []string `csp:"script-src"`
+//		Upgrade bool     `csp:"upgrade-insecure-requests"`
+//		Report  string   `csp:"report-uri"`
+//	}
+//
+// []string fields set directive sources; empty slices are skipped. bool fields are accepted for
+// upgrade-insecure-requests and block-all-mixed-content, a string field for report-uri.
+// v must be a struct or pointer to struct.
+func FromStruct(v interface{}) (*Policy, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, fmt.Errorf("cspbuilder: FromStruct nil %s", rv.Type())
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cspbuilder: FromStruct non-struct %s", rv.Type())
+	}
+
+	pol := New()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		name, ok := f.Tag.Lookup("csp")
+		if !ok || name == "-" || f.PkgPath != "" {
+			continue
+		}
+
+		name = strings.ToLower(name)
+		if !knownDirectives[name] && !fieldDirectives[name] {
+			return nil, fmt.Errorf("cspbuilder: field %s: unknown directive %s", f.Name, name)
+		}
+
+		fv := rv.Field(i)
+
+		switch {
+		case name == upgradeInsecureRequests && fv.Kind() == reflect.Bool:
+			pol.UpgradeInsecureRequests = fv.Bool()
+		case name == blockAllMixedContent && fv.Kind() == reflect.Bool:
+			pol.BlockAllMixedContent = fv.Bool()
+		case name == "report-uri" && fv.Kind() == reflect.String:
+			pol.ReportURI = fv.String()
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String &&
+			name != upgradeInsecureRequests && name != blockAllMixedContent && name != "report-uri":
+			if fv.Len() == 0 {
+				continue
+			}
+
+			sources := make([]string, fv.Len())
+			for j := range sources {
+				sources[j] = fv.Index(j).String()
+			}
+			pol.New(name, sources...)
+		default:
+			return nil, fmt.Errorf("cspbuilder: field %s: unsupported type %s for %s", f.Name, f.Type, name)
+		}
+	}
+
+	return pol, nil
+}
@@ -0,0 +1,63 @@
+package cspbuilder
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SetHeader builds the policy if needed and sets it on h as Content-Security-Policy, or
+// Content-Security-Policy-Report-Only if reportOnly or pp.ReportOnly. If the policy requires a nonce,
+// *nonce is substituted, or generated and stored in *nonce if empty. A nil nonce generates one
+// that is not returned, for responses without inline nonced elements.
+// Report-To and Reporting-Endpoints are also set if the policy had ReportEndpoints when built.
+// Safe for concurrent use if RandReader is; the policy is built once if Build() has not run.
+func (pp *Policy) SetHeader(h http.Header, reportOnly bool, nonce *string) {
+	pp.SetMergedHeader(h, reportOnly, nonce, nil)
+}
+
+// SetMergedHeader is SetHeader with sources of dirs appended to the matching directives as in MergeBuild,
+// e.g. hashes added while handling a request. dirs are merged with the policy as of the last Build(),
+// so it is safe to use while Invalidate() swaps in changes.
+func (pp *Policy) SetMergedHeader(h http.Header, reportOnly bool, nonce *string, dirs map[string]*Directive) {
+	st := pp.compiled()
+
+	if nonce == nil {
+		nonce = new(string)
+	}
+
+	cspStr, requireNonce := st.compiled, st.requireNonce
+	if len(dirs) > 0 {
+		cspStr = st.pol.MergeBuild(dirs)
+		requireNonce = strings.Contains(cspStr, Nonce)
+	}
+
+	if requireNonce {
+		switch {
+		case *nonce != "":
+			cspStr = strings.ReplaceAll(cspStr, Nonce, "'nonce-"+*nonce+"'")
+		case len(dirs) == 0:
+			cspStr = pp.WithNonce(nonce)
+		default:
+			*nonce = pp.NewNonce()
+			cspStr = strings.ReplaceAll(cspStr, Nonce, "'nonce-"+*nonce+"'")
+		}
+	}
+
+	h.Set(HeaderName(reportOnly || pp.ReportOnly), cspStr)
+
+	if st.reportTo != "" {
+		h.Set("Report-To", st.reportTo)
+	}
+
+	if st.reportingEndpoints != "" {
+		h.Set("Reporting-Endpoints", st.reportingEndpoints)
+	}
+}
+
+// HeaderName returns Content-Security-Policy, or Content-Security-Policy-Report-Only if reportOnly
+func HeaderName(reportOnly bool) string {
+	if reportOnly {
+		return "Content-Security-Policy-Report-Only"
+	}
+	return "Content-Security-Policy"
+}
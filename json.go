@@ -0,0 +1,33 @@
+package cspbuilder
+
+import "encoding/json"
+
+// directiveJSON is the JSON layout of Directive
+type directiveJSON struct {
+	Sources []string `json:"sources"`
+	Note    string   `json:"note,omitempty"`
+}
+
+// MarshalJSON encodes the directive as {"sources": [...], "note": "..."}
+func (d *Directive) MarshalJSON() ([]byte, error) {
+	return json.Marshal(directiveJSON{Sources: d.sources, Note: d.Note})
+}
+
+// UnmarshalJSON decodes the layout written by MarshalJSON.
+// Returns ErrImmutableDirective for shared global and locked directives.
+func (d *Directive) UnmarshalJSON(b []byte) error {
+	if d.immutable() {
+		return ErrImmutableDirective
+	}
+
+	var v directiveJSON
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	d.sources = nil
+	d.requireNonce = false
+	d.Note = v.Note
+	d.Add(v.Sources...)
+	return nil
+}
@@ -0,0 +1,62 @@
+package cspbuilder
+
+var (
+	level2Directives = map[string]bool{
+		BaseURI:        true,
+		Child:          true,
+		FrameAncestors: true,
+		Plugin:         true,
+		Form:           true,
+	}
+
+	level3Directives = map[string]bool{
+		TrustedTypes:           true,
+		RequireTrustedTypesFor: true,
+		StyleAttr:              true,
+		StyleElem:              true,
+		ScriptAttr:             true,
+		ScriptElem:             true,
+		Worker:                 true,
+		NavigateTo:             true,
+		Prefetch:               true,
+		Manifest:               true,
+		ReportTo:               true,
+		FencedFrame:            true,
+	}
+
+	level3Keywords = map[string]bool{
+		StrictDynamic:          true,
+		UnsafeHashes:           true,
+		UnsafeAllowRedirects:   true,
+		ReportSample:           true,
+		WasmUnsafeEval:         true,
+		InlineSpeculationRules: true,
+	}
+)
+
+// Level returns the CSP level (1, 2 or 3) required by the highest level directive or source in the policy
+func (pp *Policy) Level() int {
+	level := 1
+
+	for name, d := range pp.dirs {
+		if level3Directives[name] {
+			return 3
+		}
+
+		if level2Directives[name] {
+			level = 2
+		}
+
+		for _, v := range d.sources {
+			if level3Keywords[v] {
+				return 3
+			}
+
+			if isNonceOrHash(v) {
+				level = 2
+			}
+		}
+	}
+
+	return level
+}
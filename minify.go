@@ -0,0 +1,113 @@
+package cspbuilder
+
+import "sort"
+
+// fetchFallbacks lists the directives each fetch directive falls back to before default-src
+var fetchFallbacks = map[string][]string{
+	Child:       nil,
+	Connect:     nil,
+	Font:        nil,
+	Img:         nil,
+	Manifest:    nil,
+	Media:       nil,
+	Object:      nil,
+	Prefetch:    nil,
+	Script:      nil,
+	Style:       nil,
+	Frame:       {Child},
+	Worker:      {Child, Script},
+	FencedFrame: {Frame, Child},
+	ScriptElem:  {Script},
+	ScriptAttr:  {Script},
+	StyleElem:   {Style},
+	StyleAttr:   {Style},
+}
+
+// Minify returns a copy of the policy without fetch directives that resolve to the same
+// sources as their fallback, usually default-src. Non-fetch directives such as base-uri,
+// form-action and frame-ancestors never fall back and are kept.
+// If selfOrigin is set, the copy is compacted with Compact(selfOrigin) first.
+// Locked directives are kept and stay locked.
+func (pp *Policy) Minify(selfOrigin string) *Policy {
+	pol := pp.Merge(&Policy{})
+
+	if selfOrigin != "" {
+		pol.Compact(selfOrigin)
+	}
+
+	if _, ok := pol.dirs[Default]; !ok {
+		return pol
+	}
+
+	// effective sources of every fetch directive, which must not change
+	before := make(map[string]*Directive, len(fetchFallbacks))
+	for name := range fetchFallbacks {
+		before[name] = pol.effective(name)
+	}
+
+	names := make([]string, 0, len(fetchFallbacks))
+	for name := range pol.dirs {
+		if _, ok := fetchFallbacks[name]; ok {
+			names = append(names, name)
+		}
+	}
+
+	// resolve shorter fallback chains first, so script-src is dropped before script-src-elem is compared
+	sort.Slice(names, func(i, j int) bool {
+		li, lj := len(fetchFallbacks[names[i]]), len(fetchFallbacks[names[j]])
+		if li != lj {
+			return li < lj
+		}
+		return names[i] < names[j]
+	})
+
+	// drop a directive only if no fetch directive falling back through it changes,
+	// e.g. child-src equal to default-src is kept when worker-src would fall back to a different script-src
+	for _, name := range names {
+		if pol.locked[name] {
+			continue
+		}
+
+		d := pol.dirs[name]
+		delete(pol.dirs, name)
+
+		unchanged := true
+		for fname, src := range before {
+			if !sameSources(pol.effective(fname), src) {
+				unchanged = false
+				break
+			}
+		}
+
+		pol.dirs[name] = d
+		if unchanged {
+			pol.deleteDir(name)
+		}
+	}
+
+	return pol
+}
+
+// effective returns the directive enforced for fetch directive name: name itself,
+// its first present fallback, or default-src. Returns nil if none is set.
+func (pp *Policy) effective(name string) *Directive {
+	if d, ok := pp.dirs[name]; ok {
+		return d
+	}
+
+	for _, fb := range fetchFallbacks[name] {
+		if d, ok := pp.dirs[fb]; ok {
+			return d
+		}
+	}
+
+	return pp.dirs[Default]
+}
+
+// sameSources reports whether a and b are both unset or have the same set of sources
+func sameSources(a, b *Directive) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.equal(b)
+}
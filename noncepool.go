@@ -0,0 +1,54 @@
+package cspbuilder
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+)
+
+// NoncePool is an io.Reader that reads a large chunk from crypto/rand and
+// slices nonces from it, refilling when drained. Set it as Policy.RandReader
+// to batch entropy reads under load.
+//
+// Nonces are still from a CSPRNG, but unused entropy is held in process memory
+// until consumed. Consumed bytes are zeroed. Safe for concurrent use.
+type NoncePool struct {
+	mu  sync.Mutex
+	buf []byte
+	off int
+}
+
+// NewNoncePool creates pool holding size bytes of entropy. Defaults to 4096 if size <= 0
+func NewNoncePool(size int) *NoncePool {
+	if size <= 0 {
+		size = 4096
+	}
+
+	return &NoncePool{buf: make([]byte, size), off: size}
+}
+
+// Read fills b from the pool, refilling from crypto/rand when drained
+func (np *NoncePool) Read(b []byte) (int, error) {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+
+	var n int
+	for n < len(b) {
+		if np.off == len(np.buf) {
+			if _, err := io.ReadFull(rand.Reader, np.buf); err != nil {
+				return n, err
+			}
+			np.off = 0
+		}
+
+		c := copy(b[n:], np.buf[np.off:])
+		for i := np.off; i < np.off+c; i++ {
+			np.buf[i] = 0
+		}
+
+		np.off += c
+		n += c
+	}
+
+	return n, nil
+}
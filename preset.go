@@ -0,0 +1,64 @@
+package cspbuilder
+
+// Preset maps directive names to the sources a third party service needs
+type Preset map[string][]string
+
+// Built-in presets for common third party services
+var (
+	PresetRecaptcha = Preset{
+		Script:  {"https://www.google.com/recaptcha/", "https://www.gstatic.com/recaptcha/"},
+		Frame:   {"https://www.google.com/recaptcha/", "https://recaptcha.google.com/recaptcha/"},
+		Connect: {"https://www.google.com/recaptcha/"},
+	}
+
+	PresetStripe = Preset{
+		Script:  {"https://js.stripe.com", "https://*.js.stripe.com"},
+		Frame:   {"https://js.stripe.com", "https://*.js.stripe.com", "https://hooks.stripe.com"},
+		Connect: {"https://api.stripe.com"},
+	}
+
+	PresetYouTubeEmbed = Preset{
+		Frame: {"https://www.youtube.com", "https://www.youtube-nocookie.com"},
+		Img:   {"https://i.ytimg.com"},
+	}
+
+	PresetGoogleFonts = Preset{
+		Style: {"https://fonts.googleapis.com"},
+		Font:  {"https://fonts.gstatic.com"},
+	}
+)
+
+// Presets registers presets by name, e.g. for presets listed in config files
+var Presets = map[string]Preset{
+	"google-recaptcha": PresetRecaptcha,
+	"stripe":           PresetStripe,
+	"youtube-embed":    PresetYouTubeEmbed,
+	"google-fonts":     PresetGoogleFonts,
+}
+
+// Apply adds the sources of each preset to the policy. Existing directives are kept
+// and sources already present are not added again.
+func (pp *Policy) Apply(presets ...Preset) *Policy {
+	for _, p := range presets {
+		for name, sources := range p {
+			d, ok := pp.Get(name)
+			if !ok {
+				pp.New(name, sources...)
+				continue
+			}
+
+			var add []string
+			for _, v := range sources {
+				if !d.Contains(v) {
+					add = append(add, v)
+				}
+			}
+
+			if len(add) > 0 {
+				pp.Append(name, add...)
+			}
+		}
+	}
+
+	return pp
+}
@@ -0,0 +1,104 @@
+package cspbuilder
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ReportEndpoint is a Reporting API endpoint group, emitted as Report-To and Reporting-Endpoints headers by middleware
+type ReportEndpoint struct {
+	// Group name referenced by the report-to directive
+	Group string
+
+	URL string
+
+	// MaxAge in seconds the browser remembers the endpoint
+	MaxAge int
+}
+
+type reportToGroup struct {
+	Group     string        `json:"group"`
+	MaxAge    int           `json:"max_age"`
+	Endpoints []reportToURL `json:"endpoints"`
+}
+
+type reportToURL struct {
+	URL string `json:"url"`
+}
+
+// SetReportTo adds a Reporting API endpoint and sets "report-to <group>" directive.
+// Middleware emits the endpoints in the Report-To header.
+func (pp *Policy) SetReportTo(group, url string, maxAge int) *Policy {
+	pp.ReportEndpoints = append(pp.ReportEndpoints, ReportEndpoint{Group: group, URL: url, MaxAge: maxAge})
+	pp.New(ReportTo, group)
+	return pp
+}
+
+// ReportToHeader returns the Report-To header value for ReportEndpoints, or "" if there are none.
+// Endpoints of the same group are combined.
+func (pp *Policy) ReportToHeader() string {
+	if len(pp.ReportEndpoints) == 0 {
+		return ""
+	}
+
+	var (
+		groups []*reportToGroup
+		byName = make(map[string]*reportToGroup, len(pp.ReportEndpoints))
+	)
+
+	for _, ep := range pp.ReportEndpoints {
+		g, ok := byName[ep.Group]
+		if !ok {
+			g = &reportToGroup{Group: ep.Group, MaxAge: ep.MaxAge}
+			byName[ep.Group] = g
+			groups = append(groups, g)
+		}
+
+		if ep.MaxAge > g.MaxAge {
+			g.MaxAge = ep.MaxAge
+		}
+		g.Endpoints = append(g.Endpoints, reportToURL{URL: ep.URL})
+	}
+
+	values := make([]string, len(groups))
+	for i, g := range groups {
+		b, _ := json.Marshal(g)
+		values[i] = string(b)
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// sfStringEscaper escapes structured field string values
+var sfStringEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// ReportingEndpointsHeader returns the Reporting-Endpoints header value for ReportEndpoints,
+// e.g. csp-endpoint="https://example.com/_csp-report", or "" if there are none.
+// Reporting-Endpoints allows one URL per group; the first URL of each group is used.
+func (pp *Policy) ReportingEndpointsHeader() string {
+	if len(pp.ReportEndpoints) == 0 {
+		return ""
+	}
+
+	var (
+		sb   strings.Builder
+		seen = make(map[string]bool, len(pp.ReportEndpoints))
+	)
+
+	for _, ep := range pp.ReportEndpoints {
+		if seen[ep.Group] {
+			continue
+		}
+		seen[ep.Group] = true
+
+		if sb.Len() > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(ep.Group)
+		sb.WriteString(`="`)
+		sb.WriteString(sfStringEscaper.Replace(ep.URL))
+		sb.WriteByte('"')
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,46 @@
+package cspbuilder
+
+import "strings"
+
+// PolicyStats counts nonce, hash and wildcard usage of a policy
+type PolicyStats struct {
+	DirectiveCount int
+
+	// NonceDirectives is the number of directives with a nonce source
+	NonceDirectives int
+
+	HashSources int
+
+	// WildcardSources is the number of * and *.host sources
+	WildcardSources int
+
+	UsesUnsafeInline bool
+}
+
+// Stats computes PolicyStats from the directives without building the policy
+func (pp *Policy) Stats() PolicyStats {
+	st := PolicyStats{DirectiveCount: len(pp.dirs)}
+
+	for _, d := range pp.dirs {
+		var nonce bool
+
+		for _, v := range d.sources {
+			switch {
+			case v == Nonce || strings.HasPrefix(v, "'nonce-"):
+				nonce = true
+			case strings.HasPrefix(v, "'sha"):
+				st.HashSources++
+			case v == UnsafeInline:
+				st.UsesUnsafeInline = true
+			case strings.Contains(v, "*"):
+				st.WildcardSources++
+			}
+		}
+
+		if nonce {
+			st.NonceDirectives++
+		}
+	}
+
+	return st
+}
@@ -0,0 +1,266 @@
+package cspbuilder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// keywords are the quoted keyword sources recognized by Validate()
+var keywords = map[string]bool{
+	None:                        true,
+	Self:                        true,
+	StrictDynamic:               true,
+	UnsafeEval:                  true,
+	WasmUnsafeEval:              true,
+	UnsafeInline:                true,
+	UnsafeHashes:                true,
+	UnsafeAllowRedirects:        true,
+	ReportSample:                true,
+	TrustedScript:               true,
+	TrustedTypesAllowDuplicates: true,
+	InlineSpeculationRules:      true,
+}
+
+// Severity of a Warning
+type Severity int
+
+const (
+	// SeverityInfo notes behaviour the policy author may not expect
+	SeverityInfo Severity = iota
+	// SeverityWarning flags a likely misconfiguration
+	SeverityWarning
+	// SeverityHigh flags sources that largely defeat the policy
+	SeverityHigh
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityHigh:
+		return "high"
+	}
+	return "unknown"
+}
+
+// Warning describes a potential problem found by Validate()
+type Warning struct {
+	// Directive name the warning applies to. Empty for policy wide warnings
+	Directive string
+
+	Message string
+
+	Level Severity
+}
+
+func (w Warning) String() string {
+	if w.Directive == "" {
+		return w.Level.String() + ": " + w.Message
+	}
+	return w.Level.String() + ": " + w.Directive + ": " + w.Message
+}
+
+// MaxPolicySize is the compiled policy length in bytes above which Validate() warns.
+// Proxies and servers commonly limit header size. 0 disables the check.
+var MaxPolicySize = 4096
+
+// wildcardSensitive directives are largely defeated by the * source
+var wildcardSensitive = map[string]bool{
+	Default: true,
+	Script:  true,
+	Object:  true,
+	BaseURI: true,
+}
+
+// Validate inspects the policy and returns warnings for sources that are
+// likely misconfigured. The policy is never modified.
+func (pp *Policy) Validate() []Warning {
+	var warnings []Warning
+
+	names := make([]string, 0, len(pp.dirs))
+	for name := range pp.dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		warnings = append(warnings, validateDirective(name, pp.dirs[name])...)
+	}
+
+	if pp.UpgradeInsecureRequests && pp.BlockAllMixedContent {
+		warnings = append(warnings, Warning{
+			Directive: blockAllMixedContent,
+			Message:   "redundant with " + upgradeInsecureRequests,
+			Level:     SeverityInfo,
+		})
+	}
+
+	if n := len(pp.String()); MaxPolicySize > 0 && n > MaxPolicySize {
+		warnings = append(warnings, Warning{
+			Message: fmt.Sprintf("policy is %d bytes, over %d. Proxies may reject large headers", n, MaxPolicySize),
+			Level:   SeverityWarning,
+		})
+	}
+
+	return warnings
+}
+
+func validateDirective(name string, d *Directive) []Warning {
+	var warnings []Warning
+
+	for _, v := range d.sources {
+		if strings.HasSuffix(v, "://") {
+			warnings = append(warnings, Warning{
+				Directive: name,
+				Message:   v + " has an empty host. Use " + strings.TrimSuffix(v, "//") + " for scheme source",
+				Level:     SeverityWarning,
+			})
+		}
+	}
+
+	if wildcardSensitive[name] && d.Contains(All) {
+		warnings = append(warnings, Warning{
+			Directive: name,
+			Message:   All + " allows any host",
+			Level:     SeverityHigh,
+		})
+	}
+
+	if name != TrustedTypes && name != RequireTrustedTypesFor {
+		for _, v := range d.sources {
+			if strings.HasPrefix(v, "'") && !keywords[v] && !isNonceOrHash(v) {
+				warnings = append(warnings, Warning{
+					Directive: name,
+					Message:   v + " is not a known keyword",
+					Level:     SeverityWarning,
+				})
+			}
+		}
+	}
+
+	if d.Contains(StrictDynamic) {
+		for _, v := range d.sources {
+			if isHostOrScheme(v) {
+				warnings = append(warnings, Warning{
+					Directive: name,
+					Message:   v + " is ignored by browsers supporting " + StrictDynamic,
+					Level:     SeverityInfo,
+				})
+			}
+		}
+	}
+
+	if d.Contains(UnsafeInline) {
+		for _, v := range d.sources {
+			if isNonceOrHash(v) {
+				warnings = append(warnings, Warning{
+					Directive: name,
+					Message:   UnsafeInline + " is ignored by browsers supporting nonces and hashes when " + v + " is present",
+					Level:     SeverityInfo,
+				})
+				break
+			}
+		}
+	}
+
+	if name == NavigateTo {
+		warnings = append(warnings, Warning{
+			Directive: name,
+			Message:   "deprecated: removed from the CSP spec and not enforced by browsers",
+			Level:     SeverityWarning,
+		})
+	}
+
+	if name == RequireTrustedTypesFor {
+		for _, v := range d.sources {
+			if v != TrustedScript {
+				warnings = append(warnings, Warning{
+					Directive: name,
+					Message:   v + " is not allowed. Only " + TrustedScript + " is valid",
+					Level:     SeverityWarning,
+				})
+			}
+		}
+	}
+
+	if name == TrustedTypes {
+		for _, v := range d.sources {
+			if !isTrustedTypesSource(v) {
+				warnings = append(warnings, Warning{
+					Directive: name,
+					Message:   v + " is not a valid policy name",
+					Level:     SeverityWarning,
+				})
+			}
+		}
+	}
+
+	return warnings
+}
+
+// isTrustedTypesSource reports whether source is a trusted-types keyword or tt-policy-name
+func isTrustedTypesSource(source string) bool {
+	switch source {
+	case None, TrustedTypesAllowDuplicates, TrustedTypesWildcard:
+		return true
+	case "":
+		return false
+	}
+
+	for i := 0; i < len(source); i++ {
+		c := source[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-#=_/@.%", c) >= 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNonceOrHash reports whether source is a nonce placeholder, nonce or hash source
+func isNonceOrHash(source string) bool {
+	return source == Nonce || strings.HasPrefix(source, "'nonce-") || strings.HasPrefix(source, "'sha")
+}
+
+// isHostOrScheme reports whether source is a host or scheme source,
+// i.e. not a quoted keyword, nonce or hash.
+func isHostOrScheme(source string) bool {
+	return source != "" && source != Nonce && !strings.HasPrefix(source, "'")
+}
+
+// CheckCoverage returns the fetch directives of requiredFetch, or all fetch directives if empty,
+// that are not set explicitly or through an intermediate fallback such as script-src for script-src-elem,
+// and so fall back to default-src. Names are returned sorted.
+func (pp *Policy) CheckCoverage(requiredFetch ...string) []string {
+	if len(requiredFetch) == 0 {
+		for name := range fetchFallbacks {
+			requiredFetch = append(requiredFetch, name)
+		}
+	}
+
+	var missing []string
+
+	for _, name := range requiredFetch {
+		name = strings.ToLower(name)
+		if pp.Has(name) {
+			continue
+		}
+
+		covered := false
+		for _, fb := range fetchFallbacks[name] {
+			if pp.Has(fb) {
+				covered = true
+				break
+			}
+		}
+
+		if !covered {
+			missing = append(missing, name)
+		}
+	}
+
+	sort.Strings(missing)
+	return missing
+}